@@ -0,0 +1,207 @@
+package llrb
+
+import "reflect"
+
+// sub-tree aggregates. Trees configured with SetAggregate keep, in
+// the extension of every node, the aggregate of its sub-tree, maintained along with
+// the sub-tree count by the tree's updater, hence every
+// rotation and fixup keeps it up to date. Trees without an
+// aggregate skip it. A range is aggregated by combining the
+// aggregates of O(log n) sub-trees along the paths to its bounds.
+
+// Aggregate summarises elements of a sub-tree, as computed by the
+// functions passed to SetAggregate, nil is the identity and
+// summarises no element. Aggregates shall be treated as immutable,
+// since they are shared between versions of a LLRBMVCC tree.
+type Aggregate interface{}
+
+// ValueAggregate summarises the int64 values of KeyInt elements,
+// trees can maintain it with SetAggregate(AggregateValue,
+// CombineValues).
+type ValueAggregate struct {
+	Count    int64
+	Sum      int64
+	Min, Max int64
+}
+
+// AggregateValue returns the ValueAggregate of a KeyInt element.
+func AggregateValue(item Item) Aggregate {
+	value := item.(*KeyInt).Value
+	return ValueAggregate{Count: 1, Sum: value, Min: value, Max: value}
+}
+
+// CombineValues returns the ValueAggregate of elements summarised
+// by x followed by elements summarised by y.
+func CombineValues(x, y Aggregate) Aggregate {
+	a, b := x.(ValueAggregate), y.(ValueAggregate)
+	return ValueAggregate{
+		Count: a.Count + b.Count,
+		Sum:   a.Sum + b.Sum,
+		Min:   min(a.Min, b.Min),
+		Max:   max(a.Max, b.Max),
+	}
+}
+
+// SetAggregate maintains the aggregate of every sub-tree, of
+// returns the aggregate of an element and combine returns the
+// aggregate of elements summarised by a followed by elements
+// summarised by b, neither is called with nil. Shall be called
+// before populating the tree.
+func (t *LLRB) SetAggregate(
+	of func(Item) Aggregate, combine func(a, b Aggregate) Aggregate) {
+
+	if t.root != nil {
+		panic("setting aggregate on a populated tree")
+	}
+	t.derive(&aggregator{of: of, combine: combine}, t.intervals)
+}
+
+// Aggregate returns the aggregate of elements between low-key and
+// high-key, incl has the same semantics as that of Range. Returns
+// nil if there are no elements in the range. Tree shall be
+// configured with SetAggregate.
+func (t *LLRB) Aggregate(low, high Item, incl string) Aggregate {
+	return t.agg.aggregateRange(t.root, low, high, incl)
+}
+
+// SetAggregate is same as LLRB.SetAggregate, shall be called on the
+// writer. Snapshots and trees created by Split and Join share the
+// aggregate of their tree.
+func (t *LLRBMVCC) SetAggregate(
+	of func(Item) Aggregate, combine func(a, b Aggregate) Aggregate) {
+
+	t.mustWriter()
+	if t.Root() != nil {
+		panic("setting aggregate on a populated tree")
+	}
+	t.derive(&aggregator{of: of, combine: combine}, t.intervals)
+}
+
+// Aggregate returns the aggregate of elements between low-key and
+// high-key, incl has the same semantics as that of Range. Returns
+// nil if there are no elements in the range. Tree shall be
+// configured with SetAggregate.
+func (t *LLRBMVCC) Aggregate(low, high Item, incl string) Aggregate {
+	return t.agg.aggregateRange(t.Root(), low, high, incl)
+}
+
+// aggregator of a tree, set by SetAggregate.
+type aggregator struct {
+	of      func(Item) Aggregate
+	combine func(a, b Aggregate) Aggregate
+}
+
+// sameAggregator returns true if x and y compute the same aggregate,
+// that is, both are nil or both use the same functions.
+func sameAggregator(x, y *aggregator) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	fn := func(f interface{}) uintptr { return reflect.ValueOf(f).Pointer() }
+	return x == y || (fn(x.of) == fn(y.of) && fn(x.combine) == fn(y.combine))
+}
+
+func (ag *aggregator) aggregateRange(
+	h *Node, low, high Item, incl string) Aggregate {
+
+	if ag == nil {
+		panic("tree is not configured with an aggregate")
+	}
+	// descend to the first node that falls within the range, paths
+	// to low-key and high-key fork from this node.
+	for h != nil {
+		if !afterLow(h.Item, low, incl) {
+			h = h.Right
+		} else if !beforeHigh(h.Item, high, incl) {
+			h = h.Left
+		} else {
+			break
+		}
+	}
+	if h == nil {
+		return nil
+	}
+	agg := ag.aggregateFrom(h.Left, low, incl)
+	agg = ag.merge(agg, ag.with(h, nil, nil))
+	return ag.merge(agg, ag.aggregateTill(h.Right, high, incl))
+}
+
+// aggregateFrom returns the aggregate of elements in the sub-tree
+// rooted at h, that are after low-key.
+func (ag *aggregator) aggregateFrom(
+	h *Node, low Item, incl string) (agg Aggregate) {
+
+	for h != nil {
+		if afterLow(h.Item, low, incl) {
+			piece := ag.with(h, nil, aggregateOf(h.Right))
+			agg, h = ag.merge(piece, agg), h.Left
+		} else {
+			h = h.Right
+		}
+	}
+	return agg
+}
+
+// aggregateTill returns the aggregate of elements in the sub-tree
+// rooted at h, that are before high-key.
+func (ag *aggregator) aggregateTill(
+	h *Node, high Item, incl string) (agg Aggregate) {
+
+	for h != nil {
+		if beforeHigh(h.Item, high, incl) {
+			piece := ag.with(h, aggregateOf(h.Left), nil)
+			agg, h = ag.merge(agg, piece), h.Right
+		} else {
+			h = h.Left
+		}
+	}
+	return agg
+}
+
+// afterLow returns true if item falls after low-key, as per incl.
+func afterLow(item, low Item, incl string) bool {
+	if low == nil {
+		return true
+	} else if incl == "low" || incl == "both" {
+		return !item.Less(low)
+	}
+	return low.Less(item)
+}
+
+// beforeHigh returns true if item falls before high-key, as per
+// incl.
+func beforeHigh(item, high Item, incl string) bool {
+	if high == nil {
+		return true
+	} else if incl == "high" || incl == "both" {
+		return !high.Less(item)
+	}
+	return item.Less(high)
+}
+
+// with returns the aggregate of left, followed by element at h,
+// followed by right. Tombstones are left out.
+func (ag *aggregator) with(h *Node, left, right Aggregate) Aggregate {
+	if h.Meta.dead {
+		return ag.merge(left, right)
+	}
+	return ag.merge(ag.merge(left, ag.of(h.Item)), right)
+}
+
+// merge returns the aggregate of a followed by b, either of them
+// can be nil.
+func (ag *aggregator) merge(a, b Aggregate) Aggregate {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	return ag.combine(a, b)
+}
+
+func aggregateOf(h *Node) Aggregate {
+	if h == nil {
+		return nil
+	}
+	return extOf(h).agg
+}
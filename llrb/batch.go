@@ -0,0 +1,216 @@
+package llrb
+
+import "sync/atomic"
+
+// write batches for LLRBMVCC. A batch collects upserts, inserts
+// and deletes and Commit applies them copy-on-write against a
+// private root, which is published with a single root swap, hence
+// readers see either none or all of the writes in a batch. Nodes
+// copied, or allocated, while committing a batch are not reachable
+// by any snapshot until the batch is published, hence they are
+// owned by the batch and are modified in place by later writes in
+// the same batch, instead of being copied again. Owned nodes
+// removed by a later write in the same batch are freed to the pool
+// once the batch is applied.
+
+// Batch of writes on a LLRBMVCC tree, not safe for concurrent use.
+type Batch struct {
+	tree  *LLRBMVCC
+	ops   []byte // walUpsert, walInsert, walDelete, walDeleteMin, walDeleteMax
+	items []Item // keys of ops that take a key, in the same order
+}
+
+// private root of a batch being committed.
+type private struct {
+	root  *Node
+	owned map[*Node]bool
+}
+
+// Batch returns an empty batch of writes on this tree. Shall be
+// called on the writer.
+func (t *LLRBMVCC) Batch() *Batch {
+	t.mustWriter()
+	return &Batch{tree: t, ops: make([]byte, 0), items: make([]Item, 0)}
+}
+
+// Upsert adds an upsert of key, same as LLRBMVCC.Upsert, into the
+// batch.
+func (b *Batch) Upsert(key Item) {
+	if key == nil {
+		panic("upserting nil key")
+	}
+	b.ops, b.items = append(b.ops, walUpsert), append(b.items, key)
+}
+
+// Insert adds an insert of key, same as LLRBMVCC.Insert, into the
+// batch.
+func (b *Batch) Insert(key Item) {
+	if key == nil {
+		panic("inserting nil key")
+	}
+	b.ops, b.items = append(b.ops, walInsert), append(b.items, key)
+}
+
+// Delete adds a delete of key, same as LLRBMVCC.Delete, into the
+// batch.
+func (b *Batch) Delete(key Item) {
+	if key == nil {
+		panic("deleting nil key")
+	}
+	b.ops, b.items = append(b.ops, walDelete), append(b.items, key)
+}
+
+// DeleteMin adds a delete of the minimum element, same as
+// LLRBMVCC.DeleteMin, into the batch.
+func (b *Batch) DeleteMin() {
+	b.ops = append(b.ops, walDeleteMin)
+}
+
+// DeleteMax adds a delete of the maximum element, same as
+// LLRBMVCC.DeleteMax, into the batch.
+func (b *Batch) DeleteMax() {
+	b.ops = append(b.ops, walDeleteMax)
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit applies writes in the batch, in the order they were added,
+// and publishes them with a single root swap. Batch is empty after
+// commit and can be reused. Shall be called by the writer.
+func (b *Batch) Commit() {
+	if len(b.ops) == 0 {
+		return
+	}
+	b.tree.commit(b.ops, b.items)
+	b.tree.logBatch(b.ops, b.items)
+	b.ops, b.items = b.ops[:0], b.items[:0]
+}
+
+// commit applies ops, keys for ops that take a key are consumed
+// from items in order.
+func (t *LLRBMVCC) commit(ops []byte, items []Item) {
+	t.mustWriter()
+	t.begin()
+	defer t.discard(t.count, t.written)
+	for _, op := range ops {
+		switch op {
+		case walUpsert:
+			t.upsertKey(items[0])
+		case walInsert:
+			t.insertKey(items[0])
+		case walDelete:
+			t.deleteKey(items[0])
+		case walDeleteMin:
+			t.deleteMin()
+		case walDeleteMax:
+			t.deleteMax()
+		}
+		if op != walDeleteMin && op != walDeleteMax {
+			items = items[1:]
+		}
+	}
+	t.apply("batch")
+}
+
+// begin a private version of the tree, writes hereafter are kept
+// private until apply.
+func (t *LLRBMVCC) begin() {
+	t.batch = &private{root: t.Root(), owned: make(map[*Node]bool)}
+}
+
+// apply publishes the private version of the tree, and frees nodes
+// owned by it that were removed by a later write.
+func (t *LLRBMVCC) apply(opname string) {
+	batch := t.batch
+	t.batch = nil
+
+	// nodes owned by the batch were never published.
+	reclaim := t.reclaim[:0]
+	for _, h := range t.reclaim {
+		if !batch.owned[h] {
+			reclaim = append(reclaim, h)
+		}
+	}
+	t.reclaim = reclaim
+	t.publish(opname, batch.root)
+
+	// nodes that are not owned are never modified, hence they
+	// don't point to owned nodes, and owned nodes reachable from
+	// the root are reachable through owned nodes. Rest of them
+	// were removed by a later write in the batch.
+	var disown func(h *Node)
+	disown = func(h *Node) {
+		if h != nil && batch.owned[h] {
+			delete(batch.owned, h)
+			disown(h.Left)
+			disown(h.Right)
+		}
+	}
+	disown(batch.root)
+	for h := range batch.owned {
+		t.pool.free(h)
+	}
+}
+
+// discard drops the batch being committed, if a write in the batch
+// panicked, and restores the writer to count and written. Nodes
+// owned by the batch were never published, rest of the nodes
+// copied by the batch are still in use.
+func (t *LLRBMVCC) discard(count int, written uint64) {
+	if batch := t.batch; batch != nil {
+		t.batch, t.reclaim, t.dropped = nil, t.reclaim[:0], 0
+		t.count, t.written = count, written
+		for h := range batch.owned {
+			t.pool.free(h)
+		}
+	}
+}
+
+// tip returns the root that writes shall modify, private root of
+// the batch being committed.
+func (t *LLRBMVCC) tip() *Node {
+	if t.batch != nil {
+		return t.batch.root
+	}
+	return t.Root()
+}
+
+// publish sets root as the new root of the tree, along with the
+// seqno of the write, and reclaims nodes replaced by the write.
+// While committing a batch, root, seqno and replaced nodes are kept
+// private until the batch is applied.
+func (t *LLRBMVCC) publish(opname string, root *Node) {
+	if t.batch != nil {
+		t.batch.root = root
+		return
+	}
+	t.SetRoot(root)
+	atomic.StoreUint64(&t.seqno, t.written)
+	t.reclaimNodes(opname, t.reclaim)
+	t.reclaim = t.reclaim[:0]
+}
+
+// cow copies node h before it is modified, unless h is owned by the
+// batch being committed.
+func (t *LLRBMVCC) cow(h *Node) *Node {
+	if t.batch == nil {
+		return t.pool.cow(h, t.extended())
+	} else if h == nil || t.batch.owned[h] {
+		return h
+	}
+	hnew := t.pool.cow(h, t.extended())
+	t.batch.owned[hnew] = true
+	return hnew
+}
+
+func (t *LLRBMVCC) newNode(key Item) *Node {
+	h := t.pool.newNode(key, t.extended())
+	t.algo.Update(h)
+	if t.batch != nil {
+		t.batch.owned[h] = true
+	}
+	return h
+}
@@ -0,0 +1,120 @@
+package llrb
+
+import "math/bits"
+
+// bulk loading of pre-sorted keys. Instead of descending the tree
+// once for every key, items from the tree are merged with sorted
+// keys and a balanced tree is built bottom up, in O(n).
+
+// useBulk decides whether keys shall be loaded by rebuilding the
+// tree, that is when keys are pre-sorted and the batch is large
+// enough to amortize a full rebuild of a tree with count items.
+func useBulk(count int, keys []Item) bool {
+	if len(keys) < 2 || !isSorted(keys) {
+		return false
+	}
+	return count == 0 || len(keys)*bits.Len(uint(count)) >= count
+}
+
+// isSorted returns true if keys are in ascending sort order,
+// adjacent keys can be of equal order.
+func isSorted(keys []Item) bool {
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == nil || keys[i-1] == nil {
+			return false
+		} else if keys[i].Less(keys[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendNodes appends nodes from sub-tree h in sort order.
+func appendNodes(h *Node, nodes []*Node) []*Node {
+	if h == nil {
+		return nodes
+	}
+	nodes = appendNodes(h.Left, nodes)
+	nodes = append(nodes, h)
+	return appendNodes(h.Right, nodes)
+}
+
+// mergeItems merges items held by sorted nodes with sorted keys.
+// If an item and a key are of same order, key replaces the item.
+// Likewise the last of adjacent keys with same order is picked.
+// If dups is true, all items and keys are retained, and items
+// are placed before keys of same order.
+func mergeItems(nodes []*Node, keys []Item, dups bool) []Item {
+	items := make([]Item, 0, len(nodes)+len(keys))
+	i, j := 0, 0
+	for i < len(nodes) || j < len(keys) {
+		switch {
+		case j == len(keys):
+			items = append(items, nodes[i].Item)
+			i++
+		case i == len(nodes) || keys[j].Less(nodes[i].Item):
+			items = append(items, keys[j])
+			j++
+		case dups || nodes[i].Item.Less(keys[j]):
+			items = append(items, nodes[i].Item)
+			i++
+		default: // same order, key replaces the item.
+			i++
+		}
+		n := len(items)
+		if !dups && n > 1 && !items[n-2].Less(items[n-1]) {
+			items[n-2], items = items[n-1], items[:n-1]
+		}
+	}
+	return items
+}
+
+// buildTree builds a balanced LLRB tree from sorted items. Items
+// are laid out as a 2-3 tree of minimum height, where 3-nodes are
+// represented by a black node with a red left child. Nodes are
+// allocated by newNode.
+func buildTree(a *algo, items []Item, newNode func(Item) *Node) *Node {
+	capacity := 0 // a 2-3 tree of height h can hold 3^h - 1 items
+	for capacity < len(items) {
+		capacity = capacity*3 + 2
+	}
+	root := build23(a, items, capacity, newNode)
+	if root != nil {
+		root.Black = true
+	}
+	return root
+}
+
+// build23 builds a sub-tree, from items, whose leaves are at the
+// same black depth. capacity is the maximum number of items that
+// the sub-tree can hold for that depth.
+func build23(a *algo, items []Item, capacity int, newNode func(Item) *Node) *Node {
+	n := len(items)
+	if n == 0 {
+		return nil
+	}
+	capacity = (capacity+1)/3 - 1 // capacity of each child
+
+	if n-1 <= 2*capacity { // 2-node
+		i := (n - 1) / 2
+		h := newNode(items[i])
+		h.Black = true
+		h.Left = build23(a, items[:i], capacity, newNode)
+		h.Right = build23(a, items[i+1:], capacity, newNode)
+		a.Update(h)
+		return h
+	}
+
+	// 3-node
+	i := (n - 2) / 3
+	j := i + 1 + (n-2-i)/2
+	x := newNode(items[i])
+	x.Left = build23(a, items[:i], capacity, newNode)
+	x.Right = build23(a, items[i+1:j], capacity, newNode)
+	a.Update(x)
+	h := newNode(items[j])
+	h.Black = true
+	h.Left, h.Right = x, build23(a, items[j+1:], capacity, newNode)
+	a.Update(h)
+	return h
+}
@@ -0,0 +1,169 @@
+package llrb
+
+// Cursor is a pull-style iterator over a sorted tree. Unlike
+// Range, a cursor can be paused, stepped in either direction and
+// re-positioned with Seek.
+//
+// A cursor remembers the root it was created from. A cursor
+// obtained from an LLRBMVCC snapshot therefore stays pinned to that
+// snapshot, while a cursor obtained from an LLRB, or from the
+// writer instance of LLRBMVCC, must not be used across writes.
+type Cursor struct {
+	root  *Node
+	stack []*Node // path from root to the current node
+}
+
+func newCursor(root *Node) *Cursor {
+	return &Cursor{root: root, stack: make([]*Node, 0, 32)}
+}
+
+// Cursor returns a new cursor on the tree, positioned on
+// the minimum element.
+func (t *LLRB) Cursor() *Cursor {
+	cur := newCursor(t.root)
+	cur.First()
+	return cur
+}
+
+// Cursor returns a new cursor on the tree, positioned on
+// the minimum element. When called on a snapshot, the cursor
+// will iterate the snapshot's version of the tree.
+func (t *LLRBMVCC) Cursor() *Cursor {
+	cur := newCursor(t.Root())
+	cur.First()
+	return cur
+}
+
+// First positions the cursor on the minimum element.
+func (cur *Cursor) First() {
+	cur.stack = cur.stack[:0]
+	cur.pushLeft(cur.root)
+	cur.skipDead(true)
+}
+
+// Last positions the cursor on the maximum element.
+func (cur *Cursor) Last() {
+	cur.stack = cur.stack[:0]
+	cur.pushRight(cur.root)
+	cur.skipDead(false)
+}
+
+// Seek positions the cursor on the smallest element whose order
+// is greater than or equal to key. If key is nil, cursor is
+// positioned on the minimum element. If there is no such element
+// the cursor becomes invalid.
+func (cur *Cursor) Seek(key Item) {
+	if key == nil {
+		cur.First()
+		return
+	}
+	cur.stack = cur.stack[:0]
+	found := -1
+	h := cur.root
+	for h != nil {
+		cur.stack = append(cur.stack, h)
+		if h.Item.Less(key) {
+			h = h.Right
+		} else {
+			found = len(cur.stack) - 1
+			h = h.Left
+		}
+	}
+	cur.stack = cur.stack[:found+1]
+	cur.skipDead(true)
+}
+
+// Valid returns true if the cursor is positioned on an element.
+func (cur *Cursor) Valid() bool {
+	return len(cur.stack) > 0
+}
+
+// Item returns the element under the cursor, nil if cursor
+// is not valid.
+func (cur *Cursor) Item() Item {
+	if n := len(cur.stack); n > 0 {
+		return cur.stack[n-1].Item
+	}
+	return nil
+}
+
+// Next moves the cursor to the next element in sort order and
+// returns the same. Returns nil and invalidates the cursor if
+// there are no more elements.
+func (cur *Cursor) Next() Item {
+	cur.next()
+	cur.skipDead(true)
+	return cur.Item()
+}
+
+// Prev moves the cursor to the previous element in sort order and
+// returns the same. Returns nil and invalidates the cursor if
+// there are no more elements.
+func (cur *Cursor) Prev() Item {
+	cur.prev()
+	cur.skipDead(false)
+	return cur.Item()
+}
+
+// skipDead moves the cursor, forward or backward, past tombstones.
+func (cur *Cursor) skipDead(forward bool) {
+	for n := len(cur.stack); n > 0 && cur.stack[n-1].Meta.dead; n = len(cur.stack) {
+		if forward {
+			cur.next()
+		} else {
+			cur.prev()
+		}
+	}
+}
+
+func (cur *Cursor) next() Item {
+	n := len(cur.stack)
+	if n == 0 {
+		return nil
+	}
+	if h := cur.stack[n-1]; h.Right != nil {
+		cur.pushLeft(h.Right)
+		return cur.Item()
+	}
+	for n = len(cur.stack); n > 1; n = len(cur.stack) {
+		child := cur.stack[n-1]
+		cur.stack = cur.stack[:n-1]
+		if cur.stack[n-2].Left == child {
+			return cur.Item()
+		}
+	}
+	cur.stack = cur.stack[:0]
+	return nil
+}
+
+func (cur *Cursor) prev() Item {
+	n := len(cur.stack)
+	if n == 0 {
+		return nil
+	}
+	if h := cur.stack[n-1]; h.Left != nil {
+		cur.pushRight(h.Left)
+		return cur.Item()
+	}
+	for n = len(cur.stack); n > 1; n = len(cur.stack) {
+		child := cur.stack[n-1]
+		cur.stack = cur.stack[:n-1]
+		if cur.stack[n-2].Right == child {
+			return cur.Item()
+		}
+	}
+	cur.stack = cur.stack[:0]
+	return nil
+}
+
+func (cur *Cursor) pushLeft(h *Node) {
+	for ; h != nil; h = h.Left {
+		cur.stack = append(cur.stack, h)
+	}
+}
+
+func (cur *Cursor) pushRight(h *Node) {
+	for ; h != nil; h = h.Right {
+		cur.stack = append(cur.stack, h)
+	}
+}
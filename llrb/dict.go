@@ -58,6 +58,38 @@ func (d *Dict) Max() Item {
 	return &KeyInt{int64(kint), d.dict[kint]}
 }
 
+func (d *Dict) Floor(key Item) Item {
+	return d.lookup(key, func(k, kint int64) bool { return k <= kint }, true)
+}
+
+func (d *Dict) Ceiling(key Item) Item {
+	return d.lookup(key, func(k, kint int64) bool { return k >= kint }, false)
+}
+
+func (d *Dict) Lower(key Item) Item {
+	return d.lookup(key, func(k, kint int64) bool { return k < kint }, true)
+}
+
+func (d *Dict) Higher(key Item) Item {
+	return d.lookup(key, func(k, kint int64) bool { return k > kint }, false)
+}
+
+// lookup returns the last key, in sort order, that matches with
+// cond if last is true, otherwise returns the first key.
+func (d *Dict) lookup(key Item, cond func(k, kint int64) bool, last bool) Item {
+	kint := key.(*KeyInt).Key
+	var item Item
+	for _, k := range d.sorted() {
+		if cond(int64(k), kint) {
+			item = &KeyInt{int64(k), d.dict[k]}
+			if !last {
+				break
+			}
+		}
+	}
+	return item
+}
+
 func (d *Dict) DeleteMin() Item {
 	if len(d.dict) == 0 {
 		return nil
@@ -91,6 +123,29 @@ func (d *Dict) Upsert(key Item) Item {
 	return nil
 }
 
+func (d *Dict) UpsertFunc(key Item, fn func(old Item) (Item, bool)) Item {
+	old := d.Get(key)
+	if item, ok := fn(old); ok {
+		d.Upsert(item)
+	}
+	return old
+}
+
+// CompareAndSwap compares old by value, since Dict does not hold
+// the items themselves.
+func (d *Dict) CompareAndSwap(old, new Item) bool {
+	swapped := false
+	d.UpsertFunc(new, func(item Item) (Item, bool) {
+		if item == nil || old == nil {
+			swapped = item == nil && old == nil
+		} else {
+			swapped = *item.(*KeyInt) == *old.(*KeyInt)
+		}
+		return new, swapped
+	})
+	return swapped
+}
+
 func (d *Dict) InsertBulk(keys ...Item) {
 	for _, key := range keys {
 		d.Insert(key)
@@ -117,7 +172,38 @@ func (d *Dict) Delete(key Item) Item {
 	return nil
 }
 
+func (d *Dict) DeleteRange(low, high Item, incl string) int {
+	keys, lkey, hkey := d.bounds(low, high, incl)
+	for _, key := range keys[lkey:hkey] {
+		d.size -= 16
+		delete(d.dict, key)
+	}
+	return hkey - lkey
+}
+
 func (d *Dict) Range(low, high Item, incl string, iter KeyIterator) {
+	keys, lkey, hkey := d.bounds(low, high, incl)
+	for i := lkey; i < hkey; i++ {
+		key := &KeyInt{int64(keys[i]), d.dict[keys[i]]}
+		if !iter(key) {
+			return
+		}
+	}
+}
+
+func (d *Dict) ReverseRange(low, high Item, incl string, iter KeyIterator) {
+	keys, lkey, hkey := d.bounds(low, high, incl)
+	for i := hkey - 1; i >= lkey; i-- {
+		key := &KeyInt{int64(keys[i]), d.dict[keys[i]]}
+		if !iter(key) {
+			return
+		}
+	}
+}
+
+// bounds return sorted keys and the [lkey, hkey) index of keys
+// that fall between low and high.
+func (d *Dict) bounds(low, high Item, incl string) ([]int, int, int) {
 	keys := d.sorted()
 	lkey, hkey := 0, len(keys)
 	i := 0
@@ -163,12 +249,7 @@ func (d *Dict) Range(low, high Item, incl string, iter KeyIterator) {
 			hkey = i
 		}
 	}
-	for i := lkey; i < hkey; i++ {
-		key := &KeyInt{int64(keys[i]), d.dict[keys[i]]}
-		if !iter(key) {
-			return
-		}
-	}
+	return keys, lkey, hkey
 }
 
 func (d *Dict) sorted() []int {
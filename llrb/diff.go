@@ -0,0 +1,167 @@
+package llrb
+
+import "sync/atomic"
+
+// diff between two versions of a LLRBMVCC tree. Versions are walked
+// in sort order, one sub-tree at a time. Copy-on-write shares every
+// sub-tree that is not touched by a write, so when both versions
+// are at the same sub-tree, it is skipped without descending into
+// it, and the cost of a diff is proportional to the changes.
+
+// Diff calls fn, in sort order, for every element that differs
+// between older and newer snapshots of this writer. op is,
+//
+//	"insert" : new is present only in newer, old is nil
+//	"delete" : old is present only in older, new is nil
+//	"update" : old is replaced by new of same order
+//
+// If fn returns false, diff is stopped. The writer itself can be
+// passed for newer, in which case Diff shall be called on the
+// writer. Tombstones are treated as absent elements, hence an
+// element deleted with tombstones is reported as "delete". Returns
+// ErrReleased, or ErrExpired, without calling fn if either snapshot
+// is already released, or expired by the writer. Snapshots shall
+// not be released while the diff is in progress.
+func (t *LLRBMVCC) Diff(
+	older, newer Snapshot, fn func(op string, old, new Item) bool) error {
+
+	from, err := t.versionOf(older)
+	if err != nil {
+		return err
+	}
+	to, err := t.versionOf(newer)
+	if err != nil {
+		return err
+	}
+	a, b := newDiffer(from), newDiffer(to)
+	for len(a) > 0 && len(b) > 0 {
+		x, y := a[len(a)-1], b[len(b)-1]
+		if !x.single && !y.single && x.node == y.node {
+			a, b = a[:len(a)-1], b[:len(b)-1]
+			continue
+		}
+		kx, ky := x.min(), y.min()
+		switch {
+		case kx.Less(ky):
+			if x.single {
+				if !x.node.Meta.dead && !fn("delete", kx, nil) {
+					return nil
+				}
+				a = a[:len(a)-1]
+			} else {
+				a = a.expand()
+			}
+		case ky.Less(kx):
+			if y.single {
+				if !y.node.Meta.dead && !fn("insert", nil, ky) {
+					return nil
+				}
+				b = b[:len(b)-1]
+			} else {
+				b = b.expand()
+			}
+		case x.single && y.single:
+			if !diffPair(x.node, y.node, fn) {
+				return nil
+			}
+			a, b = a[:len(a)-1], b[:len(b)-1]
+		case !x.single && (y.single || countOf(x.node) >= countOf(y.node)):
+			a = a.expand()
+		default:
+			b = b.expand()
+		}
+	}
+	for a = a.settle(); len(a) > 0; a = a[:len(a)-1].settle() {
+		if x := a[len(a)-1]; !x.node.Meta.dead && !fn("delete", x.node.Item, nil) {
+			return nil
+		}
+	}
+	for b = b.settle(); len(b) > 0; b = b[:len(b)-1].settle() {
+		if y := b[len(b)-1]; !y.node.Meta.dead && !fn("insert", nil, y.node.Item) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// diffPair calls fn for elements of same order held by x and y,
+// if they differ.
+func diffPair(x, y *Node, fn func(op string, old, new Item) bool) bool {
+	switch {
+	case x.Meta.dead && y.Meta.dead:
+		return true
+	case x.Meta.dead:
+		return fn("insert", nil, y.Item)
+	case y.Meta.dead:
+		return fn("delete", x.Item, nil)
+	case x.Item != y.Item:
+		return fn("update", x.Item, y.Item)
+	}
+	return true
+}
+
+// versionOf returns the root of store, which shall be this writer
+// or one of its snapshots, not yet released or expired.
+func (t *LLRBMVCC) versionOf(store Snapshot) (*Node, error) {
+	version, ok := store.(*LLRBMVCC)
+	if !ok || (version != t && version.writer != t) {
+		panic("diff shall be between versions of the same writer")
+	} else if version.reader == nil {
+		return version.Root(), nil
+	} else if atomic.LoadInt32(&version.reader.expired) == 1 {
+		return nil, ErrExpired
+	} else if atomic.LoadInt32(&version.released) == 1 {
+		return nil, ErrReleased
+	}
+	return version.Root(), nil
+}
+
+// differ is a stack of sub-trees and elements that remain to be
+// walked, in reverse sort order, so that the top of the stack is
+// the next to be walked.
+type differ []diffEntry
+
+// diffEntry is either a sub-tree or, if single is true, only the
+// element held by node.
+type diffEntry struct {
+	node   *Node
+	single bool
+}
+
+func newDiffer(root *Node) differ {
+	if root == nil {
+		return differ{}
+	}
+	return differ{{node: root}}
+}
+
+func (e diffEntry) min() Item {
+	h := e.node
+	for !e.single && h.Left != nil {
+		h = h.Left
+	}
+	return h.Item
+}
+
+// expand replaces the sub-tree at the top of the stack with its
+// left sub-tree, its element and its right sub-tree.
+func (d differ) expand() differ {
+	h := d[len(d)-1].node
+	d = d[:len(d)-1]
+	if h.Right != nil {
+		d = append(d, diffEntry{node: h.Right})
+	}
+	d = append(d, diffEntry{node: h, single: true})
+	if h.Left != nil {
+		d = append(d, diffEntry{node: h.Left})
+	}
+	return d
+}
+
+// settle expands the stack until an element is at the top.
+func (d differ) settle() differ {
+	for len(d) > 0 && !d[len(d)-1].single {
+		d = d.expand()
+	}
+	return d
+}
@@ -0,0 +1,363 @@
+package llrb
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "reflect"
+
+// Dump format, all integers are big-endian:
+//
+//	header : "LLRB" | version uint16 | flags uint16 |
+//	         codec-name-len uint16 | codec-name | item-count uint64 |
+//	         [checkpoint uint64]
+//	items  : item-count times { item-len uint32 | encoded-item }
+//	trailer: crc32-castagnoli of header and items, uint32
+//
+// Items are dumped in sort order, hence loading a dump can build
+// the tree in linear time. Dumps made by Checkpoint carry the
+// checkpoint number, refer to Recover.
+
+const dumpMagic = "LLRB"
+const dumpVersion = 1
+const dumpFlagDups = 0x1
+const dumpFlagCheckpoint = 0x2
+const maxItemLen = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptDump is returned by Load when dump fails validation.
+var ErrCorruptDump = errors.New("llrb: corrupt dump")
+
+// Codec encodes and decodes items of a key type to and from its
+// binary representation in a dump.
+type Codec interface {
+	// Name uniquely identifies the codec within a dump.
+	Name() string
+
+	// Encode appends binary representation of item to buf.
+	Encode(item Item, buf []byte) []byte
+
+	// Decode an item from its binary representation.
+	Decode(data []byte) (Item, error)
+}
+
+var codecsByType = make(map[reflect.Type]Codec)
+var codecsByName = make(map[string]Codec)
+
+// RegisterCodec registers codec for items of same type as item.
+// Shall be called during initialization, before Dump or Load.
+func RegisterCodec(item Item, codec Codec) {
+	codecsByType[reflect.TypeOf(item)] = codec
+	codecsByName[codec.Name()] = codec
+}
+
+func init() {
+	RegisterCodec(&KeyInt{}, keyIntCodec{})
+	RegisterCodec(&KeyString{}, keyStringCodec{})
+	RegisterCodec(&KeyBytes{}, keyBytesCodec{})
+	RegisterCodec(&KeyInterval{}, keyIntervalCodec{})
+}
+
+// Dump the tree in sort order into w. Shall not be called
+// concurrently with writes.
+func (t *LLRB) Dump(w io.Writer) error {
+	return dumpTree(w, t.root, t.count, t.dups, 0)
+}
+
+// Load items from a dump, read from r, into the tree. If tree is
+// not empty, items are merged as with UpsertBulk.
+func (t *LLRB) Load(r io.Reader) error {
+	items, dups, _, err := loadItems(r)
+	if err != nil {
+		return err
+	} else if dups && !t.dups {
+		return fmt.Errorf("llrb: dump has duplicates, tree does not allow")
+	}
+	t.loadBulk(items)
+	return nil
+}
+
+// Dump a snapshot of the tree, in sort order, into w. Shall be
+// called on a snapshot obtained from RSnapshot, so that writer
+// is not blocked while the dump runs. If called on the writer, a
+// snapshot is taken and released after the dump.
+func (t *LLRBMVCC) Dump(w io.Writer) error {
+	if t.reader == nil {
+		snapshot := t.RSnapshot(0)
+		defer snapshot.Release()
+		return snapshot.(*LLRBMVCC).Dump(w)
+	}
+	return dumpTree(w, t.Root(), t.count, t.dups, 0)
+}
+
+// Load items from a dump, read from r, into the tree. If tree is
+// not empty, items are merged as with UpsertBulk. Shall be called
+// on the writer.
+func (t *LLRBMVCC) Load(r io.Reader) error {
+	_, err := t.load(r)
+	return err
+}
+
+// load returns the checkpoint number of the dump, zero if it was
+// not made by Checkpoint.
+func (t *LLRBMVCC) load(r io.Reader) (uint64, error) {
+	if t.reader != nil {
+		panic("cannot load into a snapshot")
+	}
+	items, dups, checkpoint, err := loadItems(r)
+	if err != nil {
+		return 0, err
+	} else if dups && !t.dups {
+		return 0, fmt.Errorf("llrb: dump has duplicates, tree does not allow")
+	}
+	t.loadBulk("insert", items)
+	return checkpoint, nil
+}
+
+// dumpTree dumps the sub-tree rooted at root, if checkpoint is not
+// zero it is dumped in the header. A dump has a single codec, hence
+// all items shall be of same type.
+func dumpTree(w io.Writer, root *Node, count int, dups bool, checkpoint uint64) error {
+	var codec Codec
+	var typ reflect.Type
+	if root != nil {
+		typ = reflect.TypeOf(root.Item)
+		if codec = codecsByType[typ]; codec == nil {
+			return fmt.Errorf("llrb: no codec for %v", typ)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(crcTable)
+	mw := io.MultiWriter(bw, crc)
+
+	// header
+	buf := make([]byte, 0, 1024)
+	buf = append(buf, dumpMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, dumpVersion)
+	flags := uint16(0)
+	if dups {
+		flags |= dumpFlagDups
+	}
+	if checkpoint > 0 {
+		flags |= dumpFlagCheckpoint
+	}
+	buf = binary.BigEndian.AppendUint16(buf, flags)
+	name := ""
+	if codec != nil {
+		name = codec.Name()
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+	buf = append(buf, name...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(count))
+	if checkpoint > 0 {
+		buf = binary.BigEndian.AppendUint64(buf, checkpoint)
+	}
+	if _, err := mw.Write(buf); err != nil {
+		return err
+	}
+
+	// items
+	var err error
+	n := 0
+	cur := newCursor(root)
+	for cur.First(); cur.Valid() && err == nil; cur.Next() {
+		item := cur.Item()
+		if reflect.TypeOf(item) != typ {
+			return fmt.Errorf("llrb: cannot dump %T along with %v", item, typ)
+		}
+		buf = append(buf[:0], 0, 0, 0, 0)
+		buf = codec.Encode(item, buf)
+		binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+		_, err = mw.Write(buf)
+		n++
+	}
+	if err != nil {
+		return err
+	} else if n != count {
+		return fmt.Errorf("llrb: dumped %v items, expected %v", n, count)
+	}
+
+	// trailer
+	buf = binary.BigEndian.AppendUint32(buf[:0], crc.Sum32())
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// loadItems returns items from a dump, whether the dump has
+// duplicates, and its checkpoint number.
+func loadItems(r io.Reader) ([]Item, bool, uint64, error) {
+	br := bufio.NewReader(r)
+	crc := crc32.New(crcTable)
+	tr := io.TeeReader(br, crc)
+	fail := func(err error) ([]Item, bool, uint64, error) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrCorruptDump
+		}
+		return nil, false, 0, err
+	}
+
+	// header
+	var hdr [10]byte
+	if _, err := io.ReadFull(tr, hdr[:]); err != nil {
+		return fail(err)
+	} else if string(hdr[:4]) != dumpMagic {
+		return fail(ErrCorruptDump)
+	}
+	version := binary.BigEndian.Uint16(hdr[4:])
+	if version != dumpVersion {
+		return fail(fmt.Errorf("llrb: unsupported dump version %v", version))
+	}
+	flags := binary.BigEndian.Uint16(hdr[6:])
+	dups := flags&dumpFlagDups != 0
+	name := make([]byte, binary.BigEndian.Uint16(hdr[8:]))
+	if _, err := io.ReadFull(tr, name); err != nil {
+		return fail(err)
+	}
+	if _, err := io.ReadFull(tr, hdr[:8]); err != nil {
+		return fail(err)
+	}
+	count := binary.BigEndian.Uint64(hdr[:8])
+	checkpoint := uint64(0)
+	if flags&dumpFlagCheckpoint != 0 {
+		if _, err := io.ReadFull(tr, hdr[:8]); err != nil {
+			return fail(err)
+		}
+		checkpoint = binary.BigEndian.Uint64(hdr[:8])
+	}
+	codec := codecsByName[string(name)]
+	if codec == nil && count > 0 {
+		return fail(fmt.Errorf("llrb: no codec named %q", name))
+	}
+
+	// items
+	items, buf := make([]Item, 0, min(count, 1024*1024)), []byte(nil)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(tr, hdr[:4]); err != nil {
+			return fail(err)
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		if n > maxItemLen {
+			return fail(ErrCorruptDump)
+		}
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return fail(err)
+		}
+		item, err := codec.Decode(buf)
+		if err != nil {
+			return fail(err)
+		}
+		items = append(items, item)
+	}
+
+	// trailer
+	sum := crc.Sum32()
+	if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+		return fail(err)
+	} else if binary.BigEndian.Uint32(hdr[:4]) != sum {
+		return fail(ErrCorruptDump)
+	}
+	if !isSorted(items) {
+		return fail(ErrCorruptDump)
+	}
+	return items, dups, checkpoint, nil
+}
+
+//-------
+// codecs
+//-------
+
+type keyIntCodec struct{}
+
+func (keyIntCodec) Name() string {
+	return "KeyInt"
+}
+
+func (keyIntCodec) Encode(item Item, buf []byte) []byte {
+	kint := item.(*KeyInt)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(kint.Key))
+	return binary.BigEndian.AppendUint64(buf, uint64(kint.Value))
+}
+
+func (keyIntCodec) Decode(data []byte) (Item, error) {
+	if len(data) != 16 {
+		return nil, ErrCorruptDump
+	}
+	key := int64(binary.BigEndian.Uint64(data))
+	value := int64(binary.BigEndian.Uint64(data[8:]))
+	return &KeyInt{key, value}, nil
+}
+
+type keyStringCodec struct{}
+
+func (keyStringCodec) Name() string {
+	return "KeyString"
+}
+
+func (keyStringCodec) Encode(item Item, buf []byte) []byte {
+	kstr := item.(*KeyString)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(kstr.Value))
+	return append(buf, kstr.Key...)
+}
+
+func (keyStringCodec) Decode(data []byte) (Item, error) {
+	if len(data) < 8 {
+		return nil, ErrCorruptDump
+	}
+	value := int64(binary.BigEndian.Uint64(data))
+	return &KeyString{string(data[8:]), value}, nil
+}
+
+type keyBytesCodec struct{}
+
+func (keyBytesCodec) Name() string {
+	return "KeyBytes"
+}
+
+func (keyBytesCodec) Encode(item Item, buf []byte) []byte {
+	kbs := item.(*KeyBytes)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(kbs.Value))
+	return append(buf, kbs.Key...)
+}
+
+func (keyBytesCodec) Decode(data []byte) (Item, error) {
+	if len(data) < 8 {
+		return nil, ErrCorruptDump
+	}
+	value := int64(binary.BigEndian.Uint64(data))
+	key := make([]byte, len(data)-8)
+	copy(key, data[8:])
+	return &KeyBytes{key, value}, nil
+}
+
+type keyIntervalCodec struct{}
+
+func (keyIntervalCodec) Name() string {
+	return "KeyInterval"
+}
+
+func (keyIntervalCodec) Encode(item Item, buf []byte) []byte {
+	kiv := item.(*KeyInterval)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(kiv.Start))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(kiv.End))
+	return binary.BigEndian.AppendUint64(buf, uint64(kiv.Value))
+}
+
+func (keyIntervalCodec) Decode(data []byte) (Item, error) {
+	if len(data) != 24 {
+		return nil, ErrCorruptDump
+	}
+	start := int64(binary.BigEndian.Uint64(data))
+	end := int64(binary.BigEndian.Uint64(data[8:]))
+	value := int64(binary.BigEndian.Uint64(data[16:]))
+	return &KeyInterval{start, end, value}, nil
+}
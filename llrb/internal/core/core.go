@@ -0,0 +1,331 @@
+// Package core implements the Left-Leaning Red-Black (LLRB)
+// algorithm shared by the Item based trees in package llrb and the
+// type-safe trees in package llrb/typed. Trees customize the
+// algorithm with hooks, to order elements, to copy nodes before
+// they are modified and to maintain data derived from sub-trees.
+package core
+
+// Node in LLRB tree, holding an element of type E along with Meta.
+// Type-safe trees keep the value of the element in Meta, Item based
+// trees keep data derived from the sub-tree rooted at the node.
+type Node[E, M any] struct {
+	Item        E
+	Left, Right *Node[E, M] // Pointers to left and right child nodes
+	// If set, the color of the link (incoming from the parent) is black
+	Black bool
+	// In the LLRB, new nodes are always red, hence the zero-value for node
+	Meta M
+}
+
+// IsRed returns true if the link from h's parent is red.
+func IsRed[E, M any](h *Node[E, M]) bool {
+	if h == nil {
+		return false
+	}
+	return !h.Black
+}
+
+// Algo implements the LLRB 2-3 algorithm on nodes of type
+// Node[E, M]. Methods return the new root of the sub-tree they
+// were called on, nodes removed from the tree are returned to the
+// caller, which shall free them.
+type Algo[E, M any] struct {
+	// Compare shall return a negative number if a is less than b,
+	// zero if a and b are of same order and a positive number if a
+	// is greater than b.
+	Compare func(a, b E) int
+	// Copy shall return a node that can be modified in place of h,
+	// either a copy of h or h itself if it is not shared. If nil,
+	// nodes are modified in place.
+	Copy func(h *Node[E, M]) *Node[E, M]
+	// Update shall recompute Meta of h from its children, it is
+	// called after h's children are modified. Can be nil.
+	Update func(h *Node[E, M])
+}
+
+// Own returns a node that can be modified in place of h.
+func (a *Algo[E, M]) Own(h *Node[E, M]) *Node[E, M] {
+	if a.Copy == nil {
+		return h
+	}
+	return a.Copy(h)
+}
+
+func (a *Algo[E, M]) update(h *Node[E, M]) {
+	if a.Update != nil {
+		a.Update(h)
+	}
+}
+
+//-----------------
+// lookup operation
+//-----------------
+
+// Get returns the node, in the sub-tree rooted at h, whose element
+// is of same order as key, nil if there is none.
+func (a *Algo[E, M]) Get(h *Node[E, M], key E) *Node[E, M] {
+	for h != nil {
+		switch c := a.Compare(key, h.Item); {
+		case c < 0:
+			h = h.Left
+		case c > 0:
+			h = h.Right
+		default:
+			return h
+		}
+	}
+	return nil
+}
+
+//----------------
+// write operation
+//----------------
+
+// Upsert inserts node n into the sub-tree rooted at h. If a node
+// of same order is present, n takes its place and the replaced
+// node is returned. n shall be a new node without children.
+func (a *Algo[E, M]) Upsert(h, n *Node[E, M]) (*Node[E, M], *Node[E, M]) {
+	if h == nil {
+		a.update(n)
+		return n, nil
+	}
+
+	var replaced *Node[E, M]
+	switch c := a.Compare(n.Item, h.Item); {
+	case c < 0:
+		h = a.Own(h)
+		h.Left, replaced = a.Upsert(h.Left, n)
+	case c > 0:
+		h = a.Own(h)
+		h.Right, replaced = a.Upsert(h.Right, n)
+	default:
+		n.Left, n.Right, n.Black = h.Left, h.Right, h.Black
+		replaced, h = h, n
+	}
+
+	return a.WalkUp(h), replaced
+}
+
+// Insert inserts node n into the sub-tree rooted at h, after nodes
+// of same order. n shall be a new node without children.
+func (a *Algo[E, M]) Insert(h, n *Node[E, M]) *Node[E, M] {
+	if h == nil {
+		a.update(n)
+		return n
+	}
+
+	h = a.Own(h)
+	if a.Compare(n.Item, h.Item) < 0 {
+		h.Left = a.Insert(h.Left, n)
+	} else {
+		h.Right = a.Insert(h.Right, n)
+	}
+
+	return a.WalkUp(h)
+}
+
+// DeleteMin removes the node with minimum element from the
+// sub-tree rooted at h, and returns the same.
+func (a *Algo[E, M]) DeleteMin(h *Node[E, M]) (*Node[E, M], *Node[E, M]) {
+	if h == nil {
+		return nil, nil
+	}
+	if h.Left == nil {
+		return nil, h
+	}
+
+	h = a.Own(h)
+	if !IsRed(h.Left) && !IsRed(h.Left.Left) {
+		h = a.MoveRedLeft(h)
+	}
+
+	var deleted *Node[E, M]
+	h.Left, deleted = a.DeleteMin(h.Left)
+
+	return a.FixUp(h), deleted
+}
+
+// DeleteMax removes the node with maximum element from the
+// sub-tree rooted at h, and returns the same.
+func (a *Algo[E, M]) DeleteMax(h *Node[E, M]) (*Node[E, M], *Node[E, M]) {
+	if h == nil {
+		return nil, nil
+	}
+
+	h = a.Own(h)
+	if IsRed(h.Left) {
+		h = a.RotateRight(h)
+	}
+	if h.Right == nil {
+		return nil, h
+	}
+	if !IsRed(h.Right) && !IsRed(h.Right.Left) {
+		h = a.MoveRedRight(h)
+	}
+
+	var deleted *Node[E, M]
+	h.Right, deleted = a.DeleteMax(h.Right)
+
+	return a.FixUp(h), deleted
+}
+
+// Delete removes a node, whose element is of same order as key,
+// from the sub-tree rooted at h, and returns the same.
+func (a *Algo[E, M]) Delete(h *Node[E, M], key E) (*Node[E, M], *Node[E, M]) {
+	if h == nil {
+		return nil, nil
+	}
+
+	var deleted *Node[E, M]
+	h = a.Own(h)
+	if a.Compare(key, h.Item) < 0 {
+		if h.Left == nil { // key not present. Nothing to delete
+			return h, nil
+		}
+		if !IsRed(h.Left) && !IsRed(h.Left.Left) {
+			h = a.MoveRedLeft(h)
+		}
+		h.Left, deleted = a.Delete(h.Left, key)
+	} else {
+		if IsRed(h.Left) {
+			h = a.RotateRight(h)
+		}
+		// If @key equals @h.Item and no right children at @h
+		if a.Compare(key, h.Item) == 0 && h.Right == nil {
+			return nil, h
+		}
+		// PETAR: Added 'h.Right != nil' below
+		if h.Right != nil && !IsRed(h.Right) && !IsRed(h.Right.Left) {
+			h = a.MoveRedRight(h)
+		}
+		// If @key equals @h.Item, and (from above) 'h.Right != nil'
+		if a.Compare(key, h.Item) == 0 {
+			var sub *Node[E, M]
+			h.Right, sub = a.DeleteMin(h.Right)
+			if sub == nil {
+				panic("logic")
+			}
+			deleted, h = h, a.Replace(h, sub)
+		} else { // Else, @key is bigger than @h.Item
+			h.Right, deleted = a.Delete(h.Right, key)
+		}
+	}
+
+	return a.FixUp(h), deleted
+}
+
+// Replace puts node n in place of h, n takes over the children and
+// color of h, and returns n or its copy. n shall not be in the tree.
+func (a *Algo[E, M]) Replace(h, n *Node[E, M]) *Node[E, M] {
+	n = a.Own(n)
+	n.Left, n.Right, n.Black = h.Left, h.Right, h.Black
+	return n
+}
+
+//----------
+// balancing
+//----------
+
+// RotateLeft rotates the red right link of h, h shall be owned.
+func (a *Algo[E, M]) RotateLeft(h *Node[E, M]) *Node[E, M] {
+	x := a.Own(h.Right)
+	if x.Black {
+		panic("rotating a black link")
+	}
+	h.Right = x.Left
+	x.Left = h
+	x.Black = h.Black
+	h.Black = false
+	a.update(h)
+	a.update(x)
+	return x
+}
+
+// RotateRight rotates the red left link of h, h shall be owned.
+func (a *Algo[E, M]) RotateRight(h *Node[E, M]) *Node[E, M] {
+	x := a.Own(h.Left)
+	if x.Black {
+		panic("rotating a black link")
+	}
+	h.Left = x.Right
+	x.Right = h
+	x.Black = h.Black
+	h.Black = false
+	a.update(h)
+	a.update(x)
+	return x
+}
+
+// Flip flips the color of h and its children, h shall be owned.
+// REQUIRE: Left and Right children must be present
+func (a *Algo[E, M]) Flip(h *Node[E, M]) {
+	h.Left, h.Right = a.Own(h.Left), a.Own(h.Right)
+	h.Black = !h.Black
+	h.Left.Black = !h.Left.Black
+	h.Right.Black = !h.Right.Black
+}
+
+// MoveRedLeft makes the left child of h, or one of its children,
+// red. h shall be owned.
+// REQUIRE: Left and Right children must be present
+func (a *Algo[E, M]) MoveRedLeft(h *Node[E, M]) *Node[E, M] {
+	a.Flip(h)
+	if IsRed(h.Right.Left) {
+		h.Right = a.RotateRight(h.Right)
+		h = a.RotateLeft(h)
+		a.Flip(h)
+	}
+	return h
+}
+
+// MoveRedRight makes the right child of h, or one of its children,
+// red. h shall be owned.
+// REQUIRE: Left and Right children must be present
+func (a *Algo[E, M]) MoveRedRight(h *Node[E, M]) *Node[E, M] {
+	a.Flip(h)
+	if IsRed(h.Left.Left) {
+		h = a.RotateRight(h)
+		a.Flip(h)
+	}
+	return h
+}
+
+// FixUp restores the invariants at h, on the way up after a
+// delete. h shall be owned.
+func (a *Algo[E, M]) FixUp(h *Node[E, M]) *Node[E, M] {
+	a.update(h)
+
+	if IsRed(h.Right) {
+		h = a.RotateLeft(h)
+	}
+
+	if IsRed(h.Left) && IsRed(h.Left.Left) {
+		h = a.RotateRight(h)
+	}
+
+	if IsRed(h.Left) && IsRed(h.Right) {
+		a.Flip(h)
+	}
+
+	return h
+}
+
+// WalkUp restores the invariants at h, on the way up after an
+// insert. h shall be owned.
+func (a *Algo[E, M]) WalkUp(h *Node[E, M]) *Node[E, M] {
+	a.update(h)
+
+	if IsRed(h.Right) && !IsRed(h.Left) {
+		h = a.RotateLeft(h)
+	}
+
+	if IsRed(h.Left) && IsRed(h.Left.Left) {
+		h = a.RotateRight(h)
+	}
+
+	if IsRed(h.Left) && IsRed(h.Right) {
+		a.Flip(h)
+	}
+
+	return h
+}
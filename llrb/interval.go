@@ -0,0 +1,134 @@
+package llrb
+
+// interval trees. A tree configured with SetIntervals is an
+// interval tree, its nodes keep, in their extension, the interval
+// that ends last in their sub-tree, maintained along with the sub-tree count by the
+// tree's updater, hence every rotation and fixup keeps it up to
+// date. Other trees skip it. A query skips sub-trees whose intervals end
+// before the query begins, and stops at the first interval that
+// starts after the query ends. Pruning is only by the end of
+// sub-trees, hence a query visits O(min(n, k log n)) nodes for k
+// overlapping intervals.
+
+// Interval is an Item spanning a closed range of points. Intervals
+// shall be ordered, by Less, on their start point.
+type Interval interface {
+	Item
+
+	// StartsAfter returns true if interval starts after point.
+	StartsAfter(point Item) bool
+
+	// EndsBefore returns true if interval ends before point.
+	EndsBefore(point Item) bool
+
+	// EndLess returns true if interval ends before other ends.
+	EndLess(other Interval) bool
+}
+
+// SetIntervals maintains, in every node, the interval ending last in
+// its sub-tree, needed by Overlaps and Stab. Items in the tree shall
+// implement Interval. Shall be called before populating the tree.
+func (t *LLRB) SetIntervals(allow bool) {
+	if t.root != nil {
+		panic("setting intervals on a populated tree")
+	}
+	t.derive(t.agg, allow)
+}
+
+// SetIntervals is same as LLRB.SetIntervals, shall be called on the
+// writer. Snapshots and trees created by Split and Join share the
+// intervals setting of their tree.
+func (t *LLRBMVCC) SetIntervals(allow bool) {
+	t.mustWriter()
+	if t.Root() != nil {
+		panic("setting intervals on a populated tree")
+	}
+	t.derive(t.agg, allow)
+}
+
+// Overlaps calls iter, in sort order, for every interval in the
+// tree that overlaps with the closed range [a, b]. Items in the
+// tree shall implement Interval.
+func (t *LLRB) Overlaps(a, b Item, iter KeyIterator) {
+	checkIntervals(t.root, t.intervals)
+	overlaps(t.root, a, b, iter)
+}
+
+// Stab calls iter, in sort order, for every interval in the tree
+// that contains point. Items in the tree shall implement Interval.
+func (t *LLRB) Stab(point Item, iter KeyIterator) {
+	checkIntervals(t.root, t.intervals)
+	overlaps(t.root, point, point, iter)
+}
+
+// Overlaps calls iter, in sort order, for every interval in the
+// tree that overlaps with the closed range [a, b]. Items in the
+// tree shall implement Interval.
+func (t *LLRBMVCC) Overlaps(a, b Item, iter KeyIterator) {
+	root := t.Root()
+	checkIntervals(root, t.intervals)
+	overlaps(root, a, b, iter)
+}
+
+// Stab calls iter, in sort order, for every interval in the tree
+// that contains point. Items in the tree shall implement Interval.
+func (t *LLRBMVCC) Stab(point Item, iter KeyIterator) {
+	root := t.Root()
+	checkIntervals(root, t.intervals)
+	overlaps(root, point, point, iter)
+}
+
+// checkIntervals panics if the tree rooted at root holds elements,
+// but is not an interval tree.
+func checkIntervals(root *Node, intervals bool) {
+	if root != nil && !intervals {
+		panic("tree is not configured with intervals")
+	}
+}
+
+func overlaps(h *Node, a, b Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	} else if maxend := extOf(h).maxend; maxend == nil {
+		return true // sub-tree holds only tombstones
+	} else if maxend.EndsBefore(a) {
+		return true
+	}
+	if !overlaps(h.Left, a, b, iter) {
+		return false
+	}
+	iv := h.Item.(Interval)
+	if iv.StartsAfter(b) { // so does the right sub-tree
+		return true
+	}
+	if !h.Meta.dead && !iv.EndsBefore(a) && !iter(h.Item) {
+		return false
+	}
+	return overlaps(h.Right, a, b, iter)
+}
+
+// updateInterval is updateNode for interval trees, also recomputes
+// the interval ending last in the sub-tree rooted at h.
+func updateInterval(h *Node) {
+	updateNode(h)
+	x := extOf(h)
+	x.maxend = nil
+	if !h.Meta.dead {
+		x.maxend = h.Item.(Interval)
+	}
+	if l := h.Left; l != nil {
+		x.maxend = laterEnd(x.maxend, extOf(l).maxend)
+	}
+	if r := h.Right; r != nil {
+		x.maxend = laterEnd(x.maxend, extOf(r).maxend)
+	}
+}
+
+// laterEnd returns the interval ending last, either of x or y can
+// be nil.
+func laterEnd(x, y Interval) Interval {
+	if x == nil || (y != nil && x.EndLess(y)) {
+		return y
+	}
+	return x
+}
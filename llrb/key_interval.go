@@ -0,0 +1,36 @@
+package llrb
+
+// KeyInterval implements a closed interval of int64, from Start
+// to End, as the sort key. Points of the interval are *KeyInt.
+type KeyInterval struct {
+	Start int64
+	End   int64
+	Value int64
+}
+
+// Less implements Item interface, intervals are ordered by their
+// start and then by their end.
+func (x *KeyInterval) Less(than Item) bool {
+	y := than.(*KeyInterval)
+	return x.Start < y.Start || (x.Start == y.Start && x.End < y.End)
+}
+
+// Size implements Item interface.
+func (x *KeyInterval) Size() int {
+	return 24
+}
+
+// StartsAfter implements Interval interface.
+func (x *KeyInterval) StartsAfter(point Item) bool {
+	return x.Start > point.(*KeyInt).Key
+}
+
+// EndsBefore implements Interval interface.
+func (x *KeyInterval) EndsBefore(point Item) bool {
+	return x.End < point.(*KeyInt).Key
+}
+
+// EndLess implements Interval interface.
+func (x *KeyInterval) EndLess(other Interval) bool {
+	return x.End < other.(*KeyInterval).End
+}
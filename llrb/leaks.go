@@ -0,0 +1,159 @@
+package llrb
+
+import "sync/atomic"
+import "time"
+
+// leaked snapshots. A snapshot that is never released holds the
+// nodes reclaimed after it was acquired, forever. Snapshots are
+// accounted in epochs, writer records when the first snapshot of
+// an epoch was acquired. Optionally, every snapshot keeps a record
+// of when it was acquired and the stack of the goroutine acquiring
+// it, so that leaks can be located. Epochs with old snapshots can
+// be force-expired, an expired epoch no more holds reclaimed nodes.
+// Since its readers might still be using their snapshots, nodes
+// allocated before expiry are not recycled by the node pool, they
+// are left to the garbage collector, hence reading an expired
+// snapshot is still safe.
+
+// SnapshotInfo describes unreleased snapshots of a tree. If stacks
+// are enabled, it describes a single snapshot, otherwise it
+// describes all snapshots acquired in the same epoch, that is
+// between the same pair of writes, and Acquired is when the first
+// of them was acquired, which might have been released since.
+type SnapshotInfo struct {
+	Acquired time.Time // when the snapshot was acquired
+	Stack    []byte    // stack of the snapshot, if enabled
+	Readers  int       // number of unreleased snapshots in the epoch
+	Pinned   int       // number of reclaimed nodes held for the epoch
+	Seqno    uint64    // seqno of the tree when epoch started
+
+	e *epoch
+}
+
+type expiry struct {
+	age     time.Duration
+	hook    func(info SnapshotInfo) bool
+	checked time.Time
+}
+
+// SetSnapshotStacks enables, or disables, recording the stack of
+// goroutines acquiring snapshots. Capturing a stack is expensive,
+// enable it only to debug leaks. Shall be called before taking
+// snapshots.
+func (t *LLRBMVCC) SetSnapshotStacks(enable bool) {
+	t.stacks = enable
+}
+
+// Snapshots returns snapshots, of this tree, acquired atleast age
+// before and are not yet released, oldest first. Pinned count of
+// an epoch includes nodes reclaimed while a later epoch, that is
+// drained, was the latest. Snapshots of trees this tree was split
+// from, or joined from, are not listed. Shall be called by the
+// writer.
+func (t *LLRBMVCC) Snapshots(age time.Duration) []SnapshotInfo {
+	if t.reader != nil {
+		panic("cannot list snapshots of a snapshot")
+	}
+	infos := make([]SnapshotInfo, 0)
+	for _, r := range t.pending() {
+		if r.pinned {
+			continue
+		}
+		e := r.epochs[0]
+		ns := atomic.LoadInt64(&e.acquired) // zero, till first reader sets it
+		if ns == 0 || time.Since(time.Unix(0, ns)) < age {
+			continue
+		}
+		info := SnapshotInfo{
+			Acquired: time.Unix(0, ns),
+			Readers:  e.readers(),
+			Pinned:   len(r.nodes),
+			Seqno:    r.seqno,
+			e:        e,
+		}
+		if atomic.LoadPointer(&e.records) == nil {
+			infos = append(infos, info)
+			continue
+		}
+		infos = append(infos, e.snapshots(info, age)...)
+	}
+	return infos
+}
+
+// snapshots returns info of every unreleased snapshot, with a
+// record, in epoch e acquired atleast age before, oldest first.
+func (e *epoch) snapshots(info SnapshotInfo, age time.Duration) []SnapshotInfo {
+	infos := make([]SnapshotInfo, 0)
+	r := (*record)(atomic.LoadPointer(&e.records))
+	for ; r != nil; r = r.next {
+		acquired := time.Unix(0, r.acquired)
+		if atomic.LoadInt32(&r.released) == 1 || time.Since(acquired) < age {
+			continue
+		}
+		info.Acquired, info.Stack = acquired, r.stack
+		infos = append(infos, info)
+	}
+	for i, j := 0, len(infos)-1; i < j; i, j = i+1, j-1 {
+		infos[i], infos[j] = infos[j], infos[i]
+	}
+	return infos
+}
+
+// SetExpiry force-expires snapshots acquired atleast age before.
+// Writer checks for such snapshots while reclaiming nodes, atmost
+// once every age/2, ExpireSnapshots can be called to check them
+// explicitly. If hook is not nil, it is called by the writer for
+// every SnapshotInfo listed by Snapshots and its epoch is expired
+// only if hook returns true, expiring an epoch expires all of its
+// snapshots. Releasing an expired snapshot returns ErrExpired. If
+// age is zero, or negative, snapshots are not expired.
+func (t *LLRBMVCC) SetExpiry(age time.Duration, hook func(SnapshotInfo) bool) {
+	if t.reader != nil {
+		panic("cannot expire snapshots of a snapshot")
+	} else if age <= 0 {
+		t.expiry = nil
+		return
+	}
+	t.expiry = &expiry{age: age, hook: hook, checked: time.Now()}
+}
+
+// ExpireSnapshots expires snapshots older than the age set by
+// SetExpiry, returns the number of snapshots expired. Shall be
+// called by the writer.
+func (t *LLRBMVCC) ExpireSnapshots() int {
+	if t.expiry == nil {
+		return 0
+	}
+	t.expiry.checked = time.Now()
+	n := 0
+	for _, info := range t.Snapshots(t.expiry.age) {
+		if t.expiry.hook != nil && !t.expiry.hook(info) {
+			continue
+		}
+		n += t.expire(info.e)
+	}
+	if n > 0 {
+		t.setSnapshots(t.gc())
+	}
+	return n
+}
+
+// checkExpiry expires old snapshots, if due.
+func (t *LLRBMVCC) checkExpiry() {
+	if t.expiry != nil && time.Since(t.expiry.checked) >= t.expiry.age/2 {
+		t.ExpireSnapshots()
+	}
+}
+
+// expire releases snapshots of a closed epoch on behalf of their
+// readers, returns the number of snapshots expired.
+func (t *LLRBMVCC) expire(e *epoch) int {
+	n := e.readers()
+	if n == 0 {
+		return 0
+	}
+	t.pool.expire() // nodes reachable by readers are not reused
+	atomic.StoreInt32(&e.expired, 1)
+	atomic.AddInt64(&t.nexpired, int64(n))
+	return n
+}
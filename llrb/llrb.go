@@ -12,14 +12,23 @@
 // observed and documented by Robert Sedgewick.
 package llrb
 
+import "unsafe"
+
 import "github.com/prataprc/golib"
+import "github.com/prataprc/golib/llrb/internal/core"
 
 // LLRB is a Left-Leaning Red-Black (LLRB) implementation
 // of 2-3 trees
 type LLRB struct {
-	count int
-	size  int
-	root  *Node
+	algo      algo
+	agg       *aggregator
+	intervals bool // set by SetIntervals
+	count     int
+	dups      bool
+	root      *Node
+	pool      *NodePool
+	snapshot  bool
+	released  bool
 }
 
 //-----
@@ -28,7 +37,7 @@ type LLRB struct {
 
 // New() allocates a new tree
 func NewLLRB() *LLRB {
-	return &LLRB{}
+	return &LLRB{algo: algo{Compare: compareItems, Update: updateNode}}
 }
 
 // SetRoot sets the root node of the tree.
@@ -41,6 +50,47 @@ func (t *LLRB) Root() *Node {
 	return t.root
 }
 
+// SetDuplicates allows, or disallows, elements of same order to
+// co-exist in the tree. Shall be called before populating the tree.
+func (t *LLRB) SetDuplicates(allow bool) {
+	t.dups = allow
+}
+
+// SetNodePool allocates nodes for this tree from pool, and frees
+// deleted nodes back to pool. Trees created by Split, Join, set
+// operations and snapshots allocate nodes from heap. Nodes of trees
+// configured with intervals or aggregate are extended, refer nodeX,
+// and are allocated from heap.
+func (t *LLRB) SetNodePool(pool *NodePool) {
+	t.pool = pool
+}
+
+// derive maintains, in every node, the aggregate of its sub-tree
+// if ag is not nil, and the interval ending last in its sub-tree
+// if intervals is true.
+func (t *LLRB) derive(ag *aggregator, intervals bool) {
+	t.agg, t.intervals = ag, intervals
+	t.algo.Update = updater(ag, intervals)
+}
+
+func (t *LLRB) newNode(key Item) *Node {
+	h := t.pool.newNode(key, t.extended())
+	t.algo.Update(h)
+	return h
+}
+
+// extended returns true if nodes of the tree are extended, refer
+// nodeX.
+func (t *LLRB) extended() bool {
+	return t.agg != nil || t.intervals
+}
+
+// Duplicates returns true if elements of same order can
+// co-exist in the tree.
+func (t *LLRB) Duplicates() bool {
+	return t.dups
+}
+
 // Len returns the number of nodes in the tree.
 func (t *LLRB) Len() int {
 	return t.count
@@ -48,7 +98,7 @@ func (t *LLRB) Len() int {
 
 // Size return the total size of keys held by this tree.
 func (t *LLRB) Size() int {
-	return t.size
+	return sizeOf(t.root)
 }
 
 //-----------------
@@ -62,8 +112,12 @@ func (t *LLRB) Has(key Item) bool {
 }
 
 // Get retrieves an element from the tree whose order is the
-// same as that of key.
+// same as that of key. If tree allows duplicates, the first
+// inserted element is returned.
 func (t *LLRB) Get(key Item) Item {
+	if t.dups {
+		return firstOf(t.root, key)
+	}
 	h := t.root
 	for h != nil {
 		switch {
@@ -78,6 +132,17 @@ func (t *LLRB) Get(key Item) Item {
 	return nil
 }
 
+// GetAll retrieves all elements from the tree whose order is the
+// same as that of key, in the order they were inserted.
+func (t *LLRB) GetAll(key Item) []Item {
+	items := make([]Item, 0, 1)
+	t.rangeFromFind(t.root, key, key, func(item Item) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
 // Min returns the minimum element in the tree.
 func (t *LLRB) Min() Item {
 	h := t.root
@@ -102,248 +167,308 @@ func (t *LLRB) Max() Item {
 	return h.Item
 }
 
+// Floor returns the largest element in the tree whose order is
+// less than or equal to that of key, nil if there is none.
+func (t *LLRB) Floor(key Item) Item {
+	return floorOf(t.root, key, true)
+}
+
+// Ceiling returns the smallest element in the tree whose order is
+// greater than or equal to that of key, nil if there is none.
+func (t *LLRB) Ceiling(key Item) Item {
+	return ceilingOf(t.root, key, true)
+}
+
+// Lower returns the largest element in the tree whose order is
+// strictly less than that of key, nil if there is none.
+func (t *LLRB) Lower(key Item) Item {
+	return floorOf(t.root, key, false)
+}
+
+// Higher returns the smallest element in the tree whose order is
+// strictly greater than that of key, nil if there is none.
+func (t *LLRB) Higher(key Item) Item {
+	return ceilingOf(t.root, key, false)
+}
+
 // UpsertBulk will upsert several keys with a single call.
-// TODO: can be optimized if keys are pre-sorted.
+// If keys are pre-sorted, they are merged with the tree and the
+// tree is rebuilt in linear time.
 func (t *LLRB) UpsertBulk(keys ...Item) {
+	if !t.dups && useBulk(t.count, keys) {
+		t.loadBulk(keys)
+		return
+	}
 	for _, key := range keys {
 		t.Upsert(key)
 	}
 }
 
 // InsertBulk will insert several keys with single call.
-// TODO: can be optimized if keys are pre-sorted.
+// If keys are pre-sorted, they are merged with the tree and the
+// tree is rebuilt in linear time.
 func (t *LLRB) InsertBulk(keys ...Item) {
+	if useBulk(t.count, keys) {
+		t.loadBulk(keys)
+		return
+	}
 	for _, key := range keys {
 		t.Insert(key)
 	}
 }
 
+func (t *LLRB) loadBulk(keys []Item) {
+	nodes := appendNodes(t.root, make([]*Node, 0, t.count))
+	items := mergeItems(nodes, keys, t.dups)
+	for _, h := range nodes {
+		t.pool.free(h)
+	}
+	t.root, t.count = buildTree(&t.algo, items, t.newNode), len(items)
+}
+
 // Upsert inserts key into the tree. If an existing
 // element has the same order, it is removed from the
-// tree and returned.
+// tree and returned. If tree allows duplicates, the first
+// inserted element of same order is replaced.
 func (t *LLRB) Upsert(key Item) Item {
 	if key == nil {
 		panic("upserting nil key")
 	}
 	var replaced Item
-	t.root, replaced = t.upsert(t.root, key)
+	if t.dups {
+		if i := rankOf(t.root, key, false); i < t.count {
+			if item := selectOf(t.root, i); !key.Less(item) {
+				return replaceAt(&t.algo, t.root, i, key)
+			}
+		}
+		t.Insert(key)
+		return nil
+	}
+	var old *Node
+	t.root, old = t.algo.Upsert(t.root, t.newNode(key))
 	t.root.Black = true
-	if replaced == nil {
+	if old == nil {
 		t.count++
+		return nil
 	}
+	replaced = old.Item
+	t.pool.free(old)
 	return replaced
 }
 
-func (t *LLRB) upsert(h *Node, key Item) (*Node, Item) {
-	if h == nil {
-		return newNode(key), nil
+// UpsertFunc calls fn with the element of same order as key, nil
+// if there is none, and within the same descent of the tree
+// replaces or inserts the item returned by fn. If fn returns false
+// tree is left untouched. Item returned by fn shall be of same
+// order as key. Returns the element passed to fn.
+func (t *LLRB) UpsertFunc(key Item, fn func(old Item) (Item, bool)) Item {
+	if key == nil {
+		panic("upserting nil key")
 	}
-
-	h = walkDownRot23(h)
-
-	var replaced Item
-	if key.Less(h.Item) { // BUG
-		h.Left, replaced = t.upsert(h.Left, key)
-	} else if h.Item.Less(key) {
-		h.Right, replaced = t.upsert(h.Right, key)
-	} else {
-		replaced, h.Item = h.Item, key
+	fn = checkUpsertFn(key, fn)
+	if t.dups {
+		if i := rankOf(t.root, key, false); i < t.count {
+			if old := selectOf(t.root, i); !key.Less(old) {
+				if item, ok := fn(old); ok {
+					replaceAt(&t.algo, t.root, i, item)
+				}
+				return old
+			}
+		}
+		if item, ok := fn(nil); ok {
+			t.Insert(item)
+		}
+		return nil
 	}
-
-	h = walkUpRot23(h)
-
-	return h, replaced
+	root, old, ok := t.upsertFunc(t.root, key, fn)
+	if ok {
+		t.root = root
+		t.root.Black = true
+		if old == nil {
+			t.count++
+		}
+	}
+	return old
 }
 
-// Insert inserts key into the tree. If an existing
-// element has the same order, both elements remain in the tree.
-func (t *LLRB) Insert(key Item) {
-	t.Upsert(key)
-	//if key == nil {
-	//    panic("inserting nil key")
-	//}
-	//t.root = t.insert(t.root, key)
-	//t.root.Black = true
-	//t.count++
-}
+func (t *LLRB) upsertFunc(
+	h *Node, key Item, fn func(Item) (Item, bool)) (*Node, Item, bool) {
 
-func (t *LLRB) insert(h *Node, key Item) *Node {
 	if h == nil {
-		return newNode(key)
+		if item, ok := fn(nil); ok {
+			return t.newNode(item), nil, true
+		}
+		return nil, nil, false
 	}
 
-	h = walkDownRot23(h)
-
+	var old, item Item
+	var ok bool
 	if key.Less(h.Item) {
-		h.Left = t.insert(h.Left, key)
+		h.Left, old, ok = t.upsertFunc(h.Left, key, fn)
+	} else if h.Item.Less(key) {
+		h.Right, old, ok = t.upsertFunc(h.Right, key, fn)
 	} else {
-		h.Right = t.insert(h.Right, key)
-	}
-
-	return walkUpRot23(h)
-}
-
-// Rotation driver routines for 2-3 algorithm
-
-func walkDownRot23(h *Node) *Node { return h }
-
-func walkUpRot23(h *Node) *Node {
-	if isRed(h.Right) && !isRed(h.Left) {
-		h = rotateLeft(h)
-	}
-
-	if isRed(h.Left) && isRed(h.Left.Left) {
-		h = rotateRight(h)
+		old = h.Item
+		if item, ok = fn(old); ok {
+			h.Item = item
+		}
 	}
-
-	if isRed(h.Left) && isRed(h.Right) {
-		flip(h)
+	if ok {
+		h = t.algo.WalkUp(h)
 	}
-
-	return h
+	return h, old, ok
 }
 
-// Rotation driver routines for 2-3-4 algorithm
-
-func walkDownRot234(h *Node) *Node {
-	if isRed(h.Left) && isRed(h.Right) {
-		flip(h)
+// CompareAndSwap replaces old with new and returns true, if old is
+// present in the tree. Elements are compared for identity. If old
+// is nil, new is inserted only when there is no element of same
+// order. new shall be of same order as old.
+func (t *LLRB) CompareAndSwap(old, new Item) bool {
+	checkSwap(old, new)
+	if t.dups && old != nil {
+		cur, i := newCursor(t.root), rankOf(t.root, new, false)
+		for cur.Seek(new); cur.Valid() && !new.Less(cur.Item()); cur.Next() {
+			if cur.Item() == old {
+				replaceAt(&t.algo, t.root, i, new)
+				return true
+			}
+			i++
+		}
+		return false
 	}
-
-	return h
+	swapped := false
+	t.UpsertFunc(new, func(item Item) (Item, bool) {
+		swapped = item == old
+		return new, swapped
+	})
+	return swapped
 }
 
-func walkUpRot234(h *Node) *Node {
-	if isRed(h.Right) && !isRed(h.Left) {
-		h = rotateLeft(h)
+// Insert inserts key into the tree. If tree allows duplicates
+// and an existing element has the same order, both elements
+// remain in the tree, otherwise Insert is same as Upsert.
+func (t *LLRB) Insert(key Item) {
+	if !t.dups {
+		t.Upsert(key)
+		return
 	}
-
-	if isRed(h.Left) && isRed(h.Left.Left) {
-		h = rotateRight(h)
+	if key == nil {
+		panic("inserting nil key")
 	}
-
-	return h
+	t.root = t.algo.Insert(t.root, t.newNode(key))
+	t.root.Black = true
+	t.count++
 }
 
 // DeleteMin deletes the minimum element in the tree and
 // returns the deleted key or nil otherwise.
 func (t *LLRB) DeleteMin() Item {
-	var deleted Item
-	t.root, deleted = deleteMin(t.root)
-	if t.root != nil {
-		t.root.Black = true
-	}
-	if deleted != nil {
-		t.count--
-	}
-	return deleted
-}
-
-// deleteMin code for LLRB 2-3 trees
-func deleteMin(h *Node) (*Node, Item) {
-	if h == nil {
-		return nil, nil
-	}
-	if h.Left == nil {
-		return nil, h.Item
-	}
-
-	if !isRed(h.Left) && !isRed(h.Left.Left) {
-		h = moveRedLeft(h)
-	}
-
-	var deleted Item
-	h.Left, deleted = deleteMin(h.Left)
-
-	return fixUp(h), deleted
+	var deleted *Node
+	t.root, deleted = t.algo.DeleteMin(t.root)
+	return t.removed(deleted)
 }
 
 // DeleteMax deletes the maximum element in the tree and
 // returns the deleted key or nil otherwise
 func (t *LLRB) DeleteMax() Item {
-	var deleted Item
-	t.root, deleted = deleteMax(t.root)
+	var deleted *Node
+	t.root, deleted = t.algo.DeleteMax(t.root)
+	return t.removed(deleted)
+}
+
+// removed accounts for node h, removed from the tree, and returns
+// its element.
+func (t *LLRB) removed(h *Node) Item {
 	if t.root != nil {
 		t.root.Black = true
 	}
-	if deleted != nil {
-		t.count--
+	if h == nil {
+		return nil
 	}
-	return deleted
+	item := h.Item
+	t.count--
+	t.pool.free(h)
+	return item
 }
 
-func deleteMax(h *Node) (*Node, Item) {
-	if h == nil {
-		return nil, nil
+// DeleteRange deletes all elements between low-key and high-key,
+// incl has the same semantics as that of Range. Returns the number
+// of deleted elements.
+func (t *LLRB) DeleteRange(low, high Item, incl string) int {
+	from, till := rankRange(t.root, low, high, incl)
+	if till <= from {
+		return 0
 	}
-	if isRed(h.Left) {
-		h = rotateRight(h)
-	}
-	if h.Right == nil {
-		return nil, h.Item
-	}
-	if !isRed(h.Right) && !isRed(h.Right.Left) {
-		h = moveRedRight(h)
-	}
-	var deleted Item
-	h.Right, deleted = deleteMax(h.Right)
-
-	return fixUp(h), deleted
+	left, _, root, bh := splitTree(&t.algo, t.root, from, blackHeight(t.root))
+	root, _, right, _ := splitTree(&t.algo, root, till-from, bh)
+	t.root = concatTree(&t.algo, left, right)
+	t.pool.freeTree(root)
+	t.count -= till - from
+	return till - from
 }
 
 // Delete deletes an key from the tree whose key equals key.
-// The deleted key is return, otherwise nil is returned.
+// The deleted key is return, otherwise nil is returned. If tree
+// allows duplicates, the first inserted element is deleted.
 func (t *LLRB) Delete(key Item) Item {
-	var deleted Item
-	t.root, deleted = t.delete(t.root, key)
-	if t.root != nil {
-		t.root.Black = true
-	}
-	if deleted != nil {
-		t.count--
+	if t.dups {
+		return t.DeleteDuplicate(key, func(Item) bool { return true })
+	}
+	var deleted *Node
+	t.root, deleted = t.algo.Delete(t.root, key)
+	return t.removed(deleted)
+}
+
+// DeleteDuplicate deletes the first element, in insertion order,
+// whose order is same as key and for which match returns true.
+// The deleted element is returned, otherwise nil is returned.
+func (t *LLRB) DeleteDuplicate(key Item, match func(Item) bool) Item {
+	cur, i := newCursor(t.root), rankOf(t.root, key, false)
+	for cur.Seek(key); cur.Valid() && !key.Less(cur.Item()); cur.Next() {
+		if match(cur.Item()) {
+			var deleted *Node
+			t.root, deleted = deleteAt(&t.algo, t.root, i)
+			return t.removed(deleted)
+		}
+		i++
 	}
-	return deleted
+	return nil
 }
 
-func (t *LLRB) delete(h *Node, key Item) (*Node, Item) {
-	var deleted Item
-	if h == nil {
-		return nil, nil
-	}
-	if key.Less(h.Item) {
-		if h.Left == nil { // key not present. Nothing to delete
-			return h, nil
-		}
+// deleteAt removes the i-th node in the sub-tree rooted at h, and
+// returns the same.
+func deleteAt(a *algo, h *Node, i int) (*Node, *Node) {
+	var deleted *Node
+	h = a.Own(h)
+	if i < countOf(h.Left) {
 		if !isRed(h.Left) && !isRed(h.Left.Left) {
-			h = moveRedLeft(h)
+			h = a.MoveRedLeft(h)
 		}
-		h.Left, deleted = t.delete(h.Left, key)
+		h.Left, deleted = deleteAt(a, h.Left, i)
 	} else {
 		if isRed(h.Left) {
-			h = rotateRight(h)
+			h = a.RotateRight(h)
 		}
-		// If @key equals @h.Item and no right children at @h
-		if !h.Item.Less(key) && h.Right == nil {
-			return nil, h.Item
+		// rotations don't change the position of i within h.
+		if i == countOf(h.Left) && h.Right == nil {
+			return nil, h
 		}
-		// PETAR: Added 'h.Right != nil' below
 		if h.Right != nil && !isRed(h.Right) && !isRed(h.Right.Left) {
-			h = moveRedRight(h)
+			h = a.MoveRedRight(h)
 		}
-		// If @key equals @h.Item, and (from above) 'h.Right != nil'
-		if !h.Item.Less(key) {
-			var subDeleted Item
-			h.Right, subDeleted = deleteMin(h.Right)
-			if subDeleted == nil {
+		if l := countOf(h.Left); i == l {
+			var sub *Node
+			h.Right, sub = a.DeleteMin(h.Right)
+			if sub == nil {
 				panic("logic")
 			}
-			deleted, h.Item = h.Item, subDeleted
-		} else { // Else, @key is bigger than @h.Item
-			h.Right, deleted = t.delete(h.Right, key)
+			deleted, h = h, a.Replace(h, sub)
+		} else {
+			h.Right, deleted = deleteAt(a, h.Right, i-l-1)
 		}
 	}
 
-	return fixUp(h), deleted
+	return a.FixUp(h), deleted
 }
 
 //----------------
@@ -452,6 +577,101 @@ func (t *LLRB) rangeAfterTill(h *Node, low, high Item, iter KeyIterator) bool {
 	return t.rangeAfterTill(h.Right, low, high, iter)
 }
 
+// ReverseRange is same as Range, except that elements are
+// iterated from high-key to low-key.
+func (t *LLRB) ReverseRange(low, high Item, incl string, iter KeyIterator) {
+	switch incl {
+	case "both":
+		t.reverseFromFind(t.root, low, high, iter)
+	case "high":
+		t.reverseAfterFind(t.root, low, high, iter)
+	case "low":
+		t.reverseFromTill(t.root, low, high, iter)
+	default:
+		t.reverseAfterTill(t.root, low, high, iter)
+	}
+}
+
+// high >= (keys) >= low
+func (t *LLRB) reverseFromFind(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && high.Less(h.Item) {
+		return t.reverseFromFind(h.Left, low, high, iter)
+	}
+	if low != nil && h.Item.Less(low) {
+		return t.reverseFromFind(h.Right, low, high, iter)
+	}
+	if !t.reverseFromFind(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item) {
+		return false
+	}
+	return t.reverseFromFind(h.Left, low, high, iter)
+}
+
+// high > (keys) >= low
+func (t *LLRB) reverseFromTill(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && !h.Item.Less(high) {
+		return t.reverseFromTill(h.Left, low, high, iter)
+	}
+	if low != nil && h.Item.Less(low) {
+		return t.reverseFromTill(h.Right, low, high, iter)
+	}
+	if !t.reverseFromTill(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item) {
+		return false
+	}
+	return t.reverseFromTill(h.Left, low, high, iter)
+}
+
+// high >= (keys) > low
+func (t *LLRB) reverseAfterFind(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && high.Less(h.Item) {
+		return t.reverseAfterFind(h.Left, low, high, iter)
+	}
+	if low != nil && !low.Less(h.Item) {
+		return t.reverseAfterFind(h.Right, low, high, iter)
+	}
+	if !t.reverseAfterFind(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item) {
+		return false
+	}
+	return t.reverseAfterFind(h.Left, low, high, iter)
+}
+
+// high > (keys) > low
+func (t *LLRB) reverseAfterTill(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && !h.Item.Less(high) {
+		return t.reverseAfterTill(h.Left, low, high, iter)
+	}
+	if low != nil && !low.Less(h.Item) {
+		return t.reverseAfterTill(h.Right, low, high, iter)
+	}
+	if !t.reverseAfterTill(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item) {
+		return false
+	}
+	return t.reverseAfterTill(h.Left, low, high, iter)
+}
+
 //--------------------
 // statistic operation
 //--------------------
@@ -498,111 +718,236 @@ func heightStats(h *Node, d int, av *golib.Average) {
 	}
 }
 
-func (t *LLRB) RSnapshot(timeout int) MemStore {
+// RSnapshot returns a clone of the tree as its snapshot.
+func (t *LLRB) RSnapshot(timeout int) Snapshot {
 	newt := NewLLRB()
-	newt.root = clone(t.root)
+	newt.derive(t.agg, t.intervals)
+	newt.root, newt.count, newt.dups = clone(t.root), t.count, t.dups
+	newt.snapshot = true
 	return newt
 }
 
+// Release implements Snapshot interface, returns ErrNotSnapshot if
+// called on a tree that is not a snapshot.
+func (t *LLRB) Release() error {
+	if !t.snapshot {
+		return ErrNotSnapshot
+	} else if t.released {
+		return ErrReleased
+	}
+	t.released = true
+	return nil
+}
+
+// ReleaseSnapshot is same as Release, ignoring the error.
+//
+// Deprecated: use Release.
 func (t *LLRB) ReleaseSnapshot() {
+	t.Release()
 }
 
 //-----
 // node
 //-----
 
-// Node in LLRB tree.
-type Node struct {
-	Item
-	Left, Right *Node // Pointers to left and right child nodes
-	// If set, the color of the link (incoming from the parent) is black
-	Black bool
-	// In the LLRB, new nodes are always red, hence the zero-value for node
+// Node in LLRB tree, balanced by the LLRB algorithm shared with
+// type-safe trees.
+type Node = core.Node[Item, meta]
+
+// meta of a node, kept along with its element.
+type meta struct {
+	dead  bool   // tombstone, element is deleted from the tree
+	ext   bool   // node is allocated as nodeX
+	gen   uint32 // generation of the pool that allocated this node
+	count int    // number of live nodes in the sub-tree rooted at this node
+	size  int    // size of live items in the sub-tree rooted at this node
 }
 
-func newNode(key Item) *Node { return &Node{Item: key} }
+// nodeX is a node extended with data needed only by trees with
+// tombstones, intervals or aggregate, so that nodes of other trees
+// don't pay for it. Extended nodes are allocated from heap, as
+// nodeX, and referred to by the address of its Node.
+type nodeX struct {
+	Node
+	x extension
+}
 
-func clone(h *Node) *Node {
-	if h == nil {
-		return nil
+// extension of a node.
+type extension struct {
+	maxend Interval  // live interval ending last in the sub-tree, if any
+	agg    Aggregate // aggregate of the sub-tree, if any
+	seqno  uint64    // sequence number of the mutation that last set this node
+}
+
+// extOf returns the extension of node h, which shall be extended.
+func extOf(h *Node) *extension {
+	if !h.Meta.ext {
+		panic("node is not extended")
 	}
-	newh := cow(h)
-	newh.Left = clone(h.Left)
-	newh.Right = clone(h.Right)
-	return newh
+	return &(*nodeX)(unsafe.Pointer(h)).x
 }
 
-func isRed(h *Node) bool {
-	if h == nil {
-		return false
+// algo balances nodes of Item based trees.
+type algo = core.Algo[Item, meta]
+
+// compareItems is the comparator of Item based trees.
+func compareItems(a, b Item) int {
+	if a.Less(b) {
+		return -1
+	} else if b.Less(a) {
+		return 1
+	}
+	return 0
+}
+
+func newNode(key Item) *Node {
+	h := &Node{Item: key}
+	updateNode(h)
+	return h
+}
+
+func newNodeX(key Item) *Node {
+	x := &nodeX{}
+	x.Item, x.Meta.ext = key, true
+	updateNode(&x.Node)
+	return &x.Node
+}
+
+// firstOf returns the first element, in sort order, from the
+// sub-tree rooted at h whose order is same as key.
+func firstOf(h *Node, key Item) Item {
+	var item Item
+	for h != nil {
+		if h.Item.Less(key) {
+			h = h.Right
+			continue
+		}
+		if !key.Less(h.Item) {
+			item = h.Item
+		}
+		h = h.Left
+	}
+	return item
+}
+
+// floorOf returns the largest element in the sub-tree rooted at
+// h, that is less than key. If equal is true, an element of same
+// order as key is also considered.
+func floorOf(h *Node, key Item, equal bool) Item {
+	var item Item
+	for h != nil {
+		if h.Item.Less(key) || (equal && !key.Less(h.Item)) {
+			item, h = h.Item, h.Right
+		} else {
+			h = h.Left
+		}
 	}
-	return !h.Black
+	return item
 }
 
-func rotateLeft(h *Node) *Node {
-	x := h.Right
-	if x.Black {
-		panic("rotating a black link")
+// ceilingOf returns the smallest element in the sub-tree rooted
+// at h, that is greater than key. If equal is true, an element of
+// same order as key is also considered.
+func ceilingOf(h *Node, key Item, equal bool) Item {
+	var item Item
+	for h != nil {
+		if key.Less(h.Item) || (equal && !h.Item.Less(key)) {
+			item, h = h.Item, h.Left
+		} else {
+			h = h.Right
+		}
 	}
-	h.Right = x.Left
-	x.Left = h
-	x.Black = h.Black
-	h.Black = false
-	return x
+	return item
 }
 
-func rotateRight(h *Node) *Node {
-	x := h.Left
-	if x.Black {
-		panic("rotating a black link")
+// replaceAt replaces the i-th element in the sub-tree rooted at h
+// with key, and returns the replaced element.
+func replaceAt(a *algo, h *Node, i int, key Item) (replaced Item) {
+	switch l := countOf(h.Left); {
+	case i < l:
+		replaced = replaceAt(a, h.Left, i, key)
+	case i > l:
+		replaced = replaceAt(a, h.Right, i-l-1, key)
+	default:
+		replaced, h.Item = h.Item, key
 	}
-	h.Left = x.Right
-	x.Right = h
-	x.Black = h.Black
-	h.Black = false
-	return x
+	a.Update(h)
+	return replaced
 }
 
-// REQUIRE: Left and Right children must be present
-func flip(h *Node) {
-	h.Black = !h.Black
-	h.Left.Black = !h.Left.Black
-	h.Right.Black = !h.Right.Black
+// checkUpsertFn wraps fn to panic if it returns an item whose
+// order is different from key.
+func checkUpsertFn(key Item, fn func(Item) (Item, bool)) func(Item) (Item, bool) {
+	return func(old Item) (Item, bool) {
+		item, ok := fn(old)
+		if ok && (item == nil || key.Less(item) || item.Less(key)) {
+			panic("upsert func shall return an item of same order as key")
+		}
+		return item, ok
+	}
 }
 
-// REQUIRE: Left and Right children must be present
-func moveRedLeft(h *Node) *Node {
-	flip(h)
-	if isRed(h.Right.Left) {
-		h.Right = rotateRight(h.Right)
-		h = rotateLeft(h)
-		flip(h)
+func checkSwap(old, new Item) {
+	if new == nil {
+		panic("swapping with nil item")
+	} else if old != nil && (old.Less(new) || new.Less(old)) {
+		panic("swapping items of different order")
 	}
-	return h
 }
 
-// REQUIRE: Left and Right children must be present
-func moveRedRight(h *Node) *Node {
-	flip(h)
-	if isRed(h.Left.Left) {
-		h = rotateRight(h)
-		flip(h)
+// countOf returns the number of live nodes in the sub-tree rooted
+// at h.
+func countOf(h *Node) int {
+	if h == nil {
+		return 0
 	}
-	return h
+	return h.Meta.count
 }
 
-func fixUp(h *Node) *Node {
-	if isRed(h.Right) {
-		h = rotateLeft(h)
+func sizeOf(h *Node) int {
+	if h == nil {
+		return 0
 	}
+	return h.Meta.size
+}
 
-	if isRed(h.Left) && isRed(h.Left.Left) {
-		h = rotateRight(h)
+// updateNode recomputes the fields of h that are derived from its
+// sub-tree, shall be called after h's children are modified.
+func updateNode(h *Node) {
+	h.Meta.count = countOf(h.Left) + countOf(h.Right)
+	h.Meta.size = sizeOf(h.Left) + sizeOf(h.Right)
+	if !h.Meta.dead {
+		h.Meta.count, h.Meta.size = h.Meta.count+1, h.Meta.size+h.Item.Size()
 	}
+}
 
-	if isRed(h.Left) && isRed(h.Right) {
-		flip(h)
+// updater returns the update hook of trees, data derived from
+// sub-trees, other than count and size, is maintained only if
+// trees are configured for it.
+func updater(ag *aggregator, intervals bool) func(*Node) {
+	update := updateNode
+	if intervals {
+		update = updateInterval
+	}
+	if ag == nil {
+		return update
 	}
+	return func(h *Node) {
+		update(h)
+		extOf(h).agg = ag.with(h, aggregateOf(h.Left), aggregateOf(h.Right))
+	}
+}
 
-	return h
+func clone(h *Node) *Node {
+	if h == nil {
+		return nil
+	}
+	newh := cow(h, false)
+	newh.Left = clone(h.Left)
+	newh.Right = clone(h.Right)
+	return newh
+}
+
+func isRed(h *Node) bool {
+	return core.IsRed(h)
 }
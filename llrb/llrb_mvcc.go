@@ -12,9 +12,8 @@
 // observed and documented by Robert Sedgewick.
 package llrb
 
+import "context"
 import "fmt"
-import "log"
-import "time"
 import "unsafe"
 import "sync/atomic"
 
@@ -27,37 +26,65 @@ var _ = fmt.Sprintf("dummy format")
 // reads.
 type LLRBMVCC struct {
 	// tree fields
-	root  unsafe.Pointer // *Node
-	count int
-	size  int
+	root      unsafe.Pointer // *Node
+	count     int
+	dups      bool
+	tombs     bool
+	intervals bool // set by SetIntervals
+	agg       *aggregator
+	seqno     uint64
 	// writer fields
-	sync         chan bool
-	snapshots    [][2]interface{} // []{chan bool, []*Node}
+	algo         algo
+	reclaim      []*Node        // nodes replaced by the write in progress
+	state        uint64         // epoch number and readers entered
+	epoch        unsafe.Pointer // *epoch, current epoch
+	snapshots    []*reclaimed
+	held         unsafe.Pointer // *[]*reclaimed, snapshots loaded by Stats
+	dropped      int            // bytes of items removed by the write in progress
 	reclaimstats map[string]*golib.Average
+	wal          *WAL
+	pool         *NodePool
+	batch        *private // batch being committed
+	written      uint64   // seqno of the latest write, till published
+	checkpoint   uint64   // number of the latest checkpoint dump
+	stacks       bool
+	expiry       *expiry
+	nexpired     int64
 	// mvcc fields
-	reader      chan bool
-	writer      *LLRBMVCC
-	count_snaps int
+	reader   *epoch
+	record   *record
+	writer   *LLRBMVCC
+	released int32
 }
 
 //-----
 // tree
 //-----
 
-// New() allocates a new tree.
+// New() allocates a new tree, number of concurrent readers is not
+// limited. maxreaders is deprecated and ignored, it is kept for
+// compatibility.
 func NewLLRBMVCC(maxreaders int) *LLRBMVCC {
-	return &LLRBMVCC{
+	t := &LLRBMVCC{
 		// writer fields
-		sync:      make(chan bool, maxreaders),
-		snapshots: make([][2]interface{}, 0),
+		epoch: unsafe.Pointer(&epoch{}),
+		pool:  NewNodePool(nil),
 		reclaimstats: map[string]*golib.Average{
-			"upsert": &golib.Average{},
-			"insert": &golib.Average{},
-			"delmin": &golib.Average{},
-			"delmax": &golib.Average{},
-			"delete": &golib.Average{},
+			"upsert":   &golib.Average{},
+			"insert":   &golib.Average{},
+			"delmin":   &golib.Average{},
+			"delmax":   &golib.Average{},
+			"delete":   &golib.Average{},
+			"delrange": &golib.Average{},
+			"split":    &golib.Average{},
+			"join":     &golib.Average{},
+			"purge":    &golib.Average{},
+			"batch":    &golib.Average{},
 		},
 	}
+	t.algo = algo{Compare: compareItems, Copy: t.own, Update: updateNode}
+	t.setSnapshots(make([]*reclaimed, 0))
+	return t
 }
 
 // SetRoot sets the root node of the tree.
@@ -70,6 +97,47 @@ func (t *LLRBMVCC) Root() *Node {
 	return (*Node)(atomic.LoadPointer(&t.root))
 }
 
+// SetDuplicates allows, or disallows, elements of same order to
+// co-exist in the tree. Shall be called before populating the tree.
+func (t *LLRBMVCC) SetDuplicates(allow bool) {
+	if allow && t.tombs {
+		panic("duplicates are not allowed with tombstones")
+	}
+	t.dups = allow
+}
+
+// SetNodePool allocates nodes for this tree from pool, nodes
+// reclaimed by writes are freed back to pool once snapshots that
+// can reach them are released. Shall be called on the writer. By
+// default nodes are allocated from heap and recycled, if pool is
+// nil reclaimed nodes are left to the garbage collector. Trees
+// created by Split, Join and set operations use a pool of their
+// own. Nodes of trees with tombstones, intervals or aggregate are
+// extended, refer nodeX, and are allocated from heap.
+func (t *LLRBMVCC) SetNodePool(pool *NodePool) {
+	pool.inherit(t.pool.generation())
+	t.pool = pool
+}
+
+// derive is same as LLRB.derive.
+func (t *LLRBMVCC) derive(ag *aggregator, intervals bool) {
+	t.agg, t.intervals = ag, intervals
+	t.algo.Update = updater(ag, intervals)
+}
+
+// extended returns true if nodes of the tree are extended, refer
+// nodeX. Nodes that are not, say when tombstones are enabled on a
+// populated tree, are extended when they are copied.
+func (t *LLRBMVCC) extended() bool {
+	return t.tombs || t.agg != nil || t.intervals
+}
+
+// Duplicates returns true if elements of same order can
+// co-exist in the tree.
+func (t *LLRBMVCC) Duplicates() bool {
+	return t.dups
+}
+
 // Len returns the number of nodes in the tree.
 func (t *LLRBMVCC) Len() int {
 	return t.count
@@ -77,7 +145,7 @@ func (t *LLRBMVCC) Len() int {
 
 // Size return the total size of keys held by this tree.
 func (t *LLRBMVCC) Size() int {
-	return t.size
+	return sizeOf(t.Root())
 }
 
 //-----------------
@@ -91,8 +159,12 @@ func (t *LLRBMVCC) Has(key Item) bool {
 }
 
 // Get retrieves an element from the tree whose order is the
-// same as that of key.
+// same as that of key. If tree allows duplicates, the first
+// inserted element is returned.
 func (t *LLRBMVCC) Get(key Item) Item {
+	if t.dups {
+		return firstOf(t.Root(), key)
+	}
 	h := t.Root()
 	for h != nil {
 		switch {
@@ -100,6 +172,8 @@ func (t *LLRBMVCC) Get(key Item) Item {
 			h = h.Left
 		case h.Item.Less(key):
 			h = h.Right
+		case h.Meta.dead:
+			return nil
 		default:
 			return h.Item
 		}
@@ -107,10 +181,25 @@ func (t *LLRBMVCC) Get(key Item) Item {
 	return nil
 }
 
+// GetAll retrieves all elements from the tree whose order is the
+// same as that of key, in the order they were inserted.
+func (t *LLRBMVCC) GetAll(key Item) []Item {
+	items := make([]Item, 0, 1)
+	t.rangeFromFind(t.Root(), key, key, func(item Item) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
 // Min returns the minimum element in the tree.
 func (t *LLRBMVCC) Min() Item {
 	h := t.Root()
-	if h == nil {
+	if t.tombs {
+		cur := newCursor(h)
+		cur.First()
+		return cur.Item()
+	} else if h == nil {
 		return nil
 	}
 	for h.Left != nil {
@@ -122,7 +211,11 @@ func (t *LLRBMVCC) Min() Item {
 // Max returns the maximum element in the tree.
 func (t *LLRBMVCC) Max() Item {
 	h := t.Root()
-	if h == nil {
+	if t.tombs {
+		cur := newCursor(h)
+		cur.Last()
+		return cur.Item()
+	} else if h == nil {
 		return nil
 	}
 	for h.Right != nil {
@@ -131,271 +224,447 @@ func (t *LLRBMVCC) Max() Item {
 	return h.Item
 }
 
+// Floor returns the largest element in the tree whose order is
+// less than or equal to that of key, nil if there is none.
+func (t *LLRBMVCC) Floor(key Item) Item {
+	if t.tombs {
+		return floorLive(t.Root(), key, true)
+	}
+	return floorOf(t.Root(), key, true)
+}
+
+// Ceiling returns the smallest element in the tree whose order is
+// greater than or equal to that of key, nil if there is none.
+func (t *LLRBMVCC) Ceiling(key Item) Item {
+	if t.tombs {
+		return ceilingLive(t.Root(), key, true)
+	}
+	return ceilingOf(t.Root(), key, true)
+}
+
+// Lower returns the largest element in the tree whose order is
+// strictly less than that of key, nil if there is none.
+func (t *LLRBMVCC) Lower(key Item) Item {
+	if t.tombs {
+		return floorLive(t.Root(), key, false)
+	}
+	return floorOf(t.Root(), key, false)
+}
+
+// Higher returns the smallest element in the tree whose order is
+// strictly greater than that of key, nil if there is none.
+func (t *LLRBMVCC) Higher(key Item) Item {
+	if t.tombs {
+		return ceilingLive(t.Root(), key, false)
+	}
+	return ceilingOf(t.Root(), key, false)
+}
+
 // UpsertBulk will upsert several keys with a single call.
-// TODO: can be optimized if keys are pre-sorted.
+// If keys are pre-sorted, they are merged with the tree and a
+// new tree is built in linear time, unless tree has tombstones.
 func (t *LLRBMVCC) UpsertBulk(keys ...Item) {
+	t.mustWriter()
+	if !t.dups && !t.tombs && useBulk(t.count, keys) {
+		t.loadBulk("upsert", keys)
+		return
+	}
 	for _, key := range keys {
 		t.Upsert(key)
 	}
 }
 
 // InsertBulk will insert several keys with single call.
-// TODO: can be optimized if keys are pre-sorted.
+// If keys are pre-sorted, they are merged with the tree and a
+// new tree is built in linear time, unless tree has tombstones.
 func (t *LLRBMVCC) InsertBulk(keys ...Item) {
+	t.mustWriter()
+	if !t.tombs && useBulk(t.count, keys) {
+		t.loadBulk("insert", keys)
+		return
+	}
 	for _, key := range keys {
 		t.Insert(key)
 	}
 }
 
+// loadBulk builds a new version of the tree, all nodes from the
+// current version are reclaimed.
+func (t *LLRBMVCC) loadBulk(opname string, keys []Item) {
+	t.dropped += sizeOf(t.Root())
+	t.reclaim = appendNodes(t.Root(), t.reclaim)
+	items := mergeItems(t.reclaim, keys, t.dups)
+	root := buildTree(&t.algo, items, t.newNode)
+	for _, key := range keys {
+		t.dropped += key.Size()
+	}
+	t.dropped -= sizeOf(root)
+	t.written++
+	walkTree(root, 0, func(h *Node, _ int) { t.stamp(h) })
+	t.publish(opname, root)
+	t.count = len(items)
+	for _, key := range keys {
+		t.logWrite(walInsert, key)
+	}
+}
+
 // Upsert inserts key into the tree. If an existing
 // element has the same order, it is removed from the
-// tree and returned.
+// tree and returned. If tree allows duplicates, the first
+// inserted element of same order is replaced.
 func (t *LLRBMVCC) Upsert(key Item) Item {
+	t.mustWriter()
+	replaced := t.upsertKey(key)
+	t.logWrite(walUpsert, key)
+	return replaced
+}
+
+func (t *LLRBMVCC) upsertKey(key Item) Item {
 	if key == nil {
 		panic("upserting nil key")
 	}
 	var replaced Item
-	reclaim := make([]*Node, 0, 64)
-	root := t.Root()
-	root, replaced, reclaim = t.upsert(root, key, reclaim)
-	t.reclaimNodes("upsert", reclaim)
+	root := t.tip()
+	t.written++
+	if t.dups {
+		i := rankOf(root, key, false)
+		if i == t.count || key.Less(selectOf(root, i)) {
+			t.insertKey(key)
+			return nil
+		}
+		root, replaced = t.replaceAtCOW(root, i, key)
+		t.publish("upsert", root)
+		return replaced
+	}
+	var old *Node
+	root, old = t.algo.Upsert(root, t.stamp(t.newNode(key)))
 	root.Black = true
-	t.SetRoot(root)
+	if old != nil {
+		t.reclaim = append(t.reclaim, old)
+		t.drop(old.Item)
+		if !old.Meta.dead { // else revive the tombstone
+			replaced = old.Item
+		}
+	}
+	t.publish("upsert", root)
 	if replaced == nil {
 		t.count++
 	}
 	return replaced
 }
 
-func (t *LLRBMVCC) upsert(
-	h *Node, key Item, reclaim []*Node) (*Node, Item, []*Node) {
-
-	if h == nil {
-		return newNode(key), nil, reclaim
+// UpsertFunc calls fn with the element of same order as key, nil
+// if there is none, and within the same descent of the tree
+// replaces or inserts the item returned by fn. If fn returns false
+// tree is left untouched and no node is copied. Item returned by
+// fn shall be of same order as key. Returns the element passed
+// to fn.
+func (t *LLRBMVCC) UpsertFunc(key Item, fn func(old Item) (Item, bool)) Item {
+	t.mustWriter()
+	if key == nil {
+		panic("upserting nil key")
 	}
-
-	reclaim = append(reclaim, h)
-	hnew := cow(h)
-
-	hnew = walkDownRot23COW(hnew)
-
-	var replaced Item
-	if key.Less(hnew.Item) { // BUG
-		hnew.Left, replaced, reclaim = t.upsert(hnew.Left, key, reclaim)
-	} else if hnew.Item.Less(key) {
-		hnew.Right, replaced, reclaim = t.upsert(hnew.Right, key, reclaim)
-	} else {
-		replaced, hnew.Item = hnew.Item, key
+	var upserted Item
+	fn = checkUpsertFn(key, fn)
+	old := t.upsertFuncKey(key, func(old Item) (Item, bool) {
+		item, ok := fn(old)
+		if ok {
+			upserted = item
+		}
+		return item, ok
+	})
+	if upserted != nil {
+		t.logWrite(walUpsert, upserted)
 	}
-
-	hnew, reclaim = walkUpRot23COW(hnew, reclaim)
-	return hnew, replaced, reclaim
+	return old
 }
 
-// Insert inserts key into the tree. If an existing
-// element has the same order, both elements remain in the tree.
-func (t *LLRBMVCC) Insert(key Item) {
-	t.Upsert(key)
-	//if key == nil {
-	//    panic("inserting nil key")
-	//}
-	//reclaim := []*Node{}
-	//root := t.Root()
-	//root, reclaim = t.insert(root, key, reclaim)
-	//t.reclaimNodes("insert", reclaim)
-	//root.Black = true
-	//t.SetRoot(root)
-	//t.count++
-}
-
-func (t *LLRBMVCC) insert(h *Node, key Item, reclaim []*Node) (*Node, []*Node) {
-	if h == nil {
-		return newNode(key), reclaim
+func (t *LLRBMVCC) upsertFuncKey(key Item, fn func(Item) (Item, bool)) Item {
+	root := t.Root()
+	t.written++
+	if t.dups {
+		if i := rankOf(root, key, false); i < t.count {
+			if old := selectOf(root, i); !key.Less(old) {
+				if item, ok := fn(old); ok {
+					root, _ = t.replaceAtCOW(root, i, item)
+					t.publish("upsert", root)
+				}
+				return old
+			}
+		}
+		if item, ok := fn(nil); ok {
+			t.insertKey(item)
+		}
+		return nil
 	}
+	root, old, ok := t.upsertFunc(root, key, fn)
+	if ok {
+		root.Black = true
+		t.publish("upsert", root)
+		if old == nil {
+			t.count++
+		}
+	}
+	return old
+}
 
-	reclaim = append(reclaim, h)
-	hnew := cow(h)
+// upsertFunc copies nodes on the way up, only if fn decides to
+// modify the tree.
+func (t *LLRBMVCC) upsertFunc(
+	h *Node, key Item, fn func(Item) (Item, bool)) (*Node, Item, bool) {
 
-	hnew = walkDownRot23COW(hnew)
+	if h == nil {
+		if item, ok := fn(nil); ok {
+			return t.stamp(t.newNode(item)), nil, true
+		}
+		return nil, nil, false
+	}
 
-	if key.Less(hnew.Item) {
-		hnew.Left, reclaim = t.insert(hnew.Left, key, reclaim)
+	var old, item Item
+	var child *Node
+	var ok bool
+	hnew := h
+	if key.Less(h.Item) {
+		if child, old, ok = t.upsertFunc(h.Left, key, fn); ok {
+			hnew = t.algo.Own(h)
+			hnew.Left = child
+		}
+	} else if h.Item.Less(key) {
+		if child, old, ok = t.upsertFunc(h.Right, key, fn); ok {
+			hnew = t.algo.Own(h)
+			hnew.Right = child
+		}
 	} else {
-		hnew.Right, reclaim = t.insert(hnew.Right, key, reclaim)
+		if !h.Meta.dead {
+			old = h.Item
+		}
+		if item, ok = fn(old); ok {
+			hnew = t.stamp(t.algo.Own(h))
+			t.drop(hnew.Item)
+			hnew.Item = item
+			hnew.Meta.dead = false // revive, if a tombstone
+		}
 	}
-
-	hnew, reclaim = walkUpRot23COW(hnew, reclaim)
-	return hnew, reclaim
+	if !ok {
+		return h, old, false
+	}
+	return t.algo.WalkUp(hnew), old, true
 }
 
-// Rotation driver routines for 2-3 algorithm
-
-func walkDownRot23COW(hnew *Node) *Node { return hnew }
-
-func walkUpRot23COW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	if isRed(hnew.Right) && !isRed(hnew.Left) {
-		hnew, reclaim = rotateLeftCOW(hnew, reclaim)
+// CompareAndSwap replaces old with new and returns true, if old is
+// present in the tree. Elements are compared for identity. If old
+// is nil, new is inserted only when there is no element of same
+// order. new shall be of same order as old.
+func (t *LLRBMVCC) CompareAndSwap(old, new Item) bool {
+	t.mustWriter()
+	checkSwap(old, new)
+	if t.dups && old != nil {
+		match := func(item Item) bool { return item == old }
+		if t.swapDuplicate(new, match) {
+			t.logWrite(walSwap, old, new)
+			return true
+		}
+		return false
 	}
+	swapped := false
+	t.UpsertFunc(new, func(item Item) (Item, bool) {
+		swapped = item == old
+		return new, swapped
+	})
+	return swapped
+}
 
-	if isRed(hnew.Left) && isRed(hnew.Left.Left) {
-		hnew, reclaim = rotateRightCOW(hnew, reclaim)
+// swapDuplicate replaces the first element, in insertion order,
+// of same order as key and for which match returns true.
+func (t *LLRBMVCC) swapDuplicate(key Item, match func(Item) bool) bool {
+	root := t.Root()
+	cur, i := newCursor(root), rankOf(root, key, false)
+	for cur.Seek(key); cur.Valid() && !key.Less(cur.Item()); cur.Next() {
+		if match(cur.Item()) {
+			t.written++
+			root, _ = t.replaceAtCOW(root, i, key)
+			t.publish("upsert", root)
+			return true
+		}
+		i++
 	}
+	return false
+}
 
-	if isRed(hnew.Left) && isRed(hnew.Right) {
-		reclaim = flipCOW(hnew, reclaim)
-	}
+// Insert inserts key into the tree. If tree allows duplicates
+// and an existing element has the same order, both elements
+// remain in the tree, otherwise Insert is same as Upsert.
+func (t *LLRBMVCC) Insert(key Item) {
+	t.mustWriter()
+	t.insertKey(key)
+	t.logWrite(walInsert, key)
+}
 
-	return hnew, reclaim
+func (t *LLRBMVCC) insertKey(key Item) {
+	if !t.dups {
+		t.upsertKey(key)
+		return
+	}
+	if key == nil {
+		panic("inserting nil key")
+	}
+	root := t.tip()
+	t.written++
+	root = t.algo.Insert(root, t.stamp(t.newNode(key)))
+	root.Black = true
+	t.publish("insert", root)
+	t.count++
 }
 
 // DeleteMin deletes the minimum element in the tree and
 // returns the deleted key or nil otherwise.
 func (t *LLRBMVCC) DeleteMin() Item {
-	var deleted Item
-	reclaim := []*Node{}
-	root := t.Root()
-	root, deleted, reclaim = deleteMinCOW(root, reclaim)
-	t.reclaimNodes("delmin", reclaim)
-	if root != nil {
-		root.Black = true
-	}
-	t.SetRoot(root)
+	t.mustWriter()
+	deleted := t.deleteMin()
 	if deleted != nil {
-		t.count--
+		t.logWrite(walDeleteMin)
 	}
 	return deleted
 }
 
-// deleteMinCOW code for LLRBMVCC 2-3 trees
-func deleteMinCOW(h *Node, reclaim []*Node) (*Node, Item, []*Node) {
-	if h == nil {
-		return nil, nil, reclaim
-	}
-	if h.Left == nil {
-		reclaim = append(reclaim, h)
-		return nil, h.Item, reclaim
-	}
-
-	reclaim = append(reclaim, h)
-	hnew := cow(h)
-
-	if !isRed(hnew.Left) && !isRed(hnew.Left.Left) {
-		hnew, reclaim = moveRedLeftCOW(hnew, reclaim)
+func (t *LLRBMVCC) deleteMin() Item {
+	if t.tombs {
+		cur := newCursor(t.tip())
+		if cur.First(); cur.Valid() {
+			return t.killKey("delmin", cur.Item())
+		}
+		return nil
 	}
-
-	var deleted Item
-	hnew.Left, deleted, reclaim = deleteMinCOW(hnew.Left, reclaim)
-
-	hnew, reclaim = fixUpCOW(hnew, reclaim)
-	return hnew, deleted, reclaim
+	root, removed := t.algo.DeleteMin(t.tip())
+	return t.removed("delmin", root, removed)
 }
 
 // DeleteMax deletes the maximum element in the tree and
 // returns the deleted key or nil otherwise
 func (t *LLRBMVCC) DeleteMax() Item {
+	t.mustWriter()
+	deleted := t.deleteMax()
+	if deleted != nil {
+		t.logWrite(walDeleteMax)
+	}
+	return deleted
+}
+
+func (t *LLRBMVCC) deleteMax() Item {
+	if t.tombs {
+		cur := newCursor(t.tip())
+		if cur.Last(); cur.Valid() {
+			return t.killKey("delmax", cur.Item())
+		}
+		return nil
+	}
+	root, removed := t.algo.DeleteMax(t.tip())
+	return t.removed("delmax", root, removed)
+}
+
+// removed publishes root, after node h is removed from the tree by
+// the write in progress, and returns the element of h.
+func (t *LLRBMVCC) removed(opname string, root, h *Node) Item {
 	var deleted Item
-	reclaim := []*Node{}
-	root := t.Root()
-	root, deleted, reclaim = deleteMaxCOW(root, reclaim)
-	t.reclaimNodes("delmax", reclaim)
+	t.written++
 	if root != nil {
 		root.Black = true
 	}
-	t.SetRoot(root)
-	if deleted != nil {
+	if h != nil {
+		deleted = h.Item // before removed node is recycled
+		t.reclaim = append(t.reclaim, h)
+		t.drop(deleted)
 		t.count--
 	}
+	t.publish(opname, root)
 	return deleted
 }
 
-func deleteMaxCOW(h *Node, reclaim []*Node) (*Node, Item, []*Node) {
-	if h == nil {
-		return nil, nil, reclaim
+// DeleteRange deletes all elements between low-key and high-key,
+// incl has the same semantics as that of Range. Returns the number
+// of deleted elements.
+func (t *LLRBMVCC) DeleteRange(low, high Item, incl string) int {
+	t.mustWriter()
+	n := t.deleteRange(low, high, incl)
+	if n > 0 {
+		t.logRange(walDeleteRange, low, high, incl)
 	}
+	return n
+}
 
-	reclaim = append(reclaim, h)
-	hnew := cow(h)
-
-	if isRed(hnew.Left) {
-		hnew, reclaim = rotateRightCOW(hnew, reclaim)
-	}
-	if hnew.Right == nil {
-		return nil, hnew.Item, reclaim
-	}
-	if !isRed(hnew.Right) && !isRed(hnew.Right.Left) {
-		hnew, reclaim = moveRedRightCOW(hnew, reclaim)
+func (t *LLRBMVCC) deleteRange(low, high Item, incl string) int {
+	if t.tombs {
+		keys := make([]Item, 0)
+		t.Range(low, high, incl, func(item Item) bool {
+			keys = append(keys, item)
+			return true
+		})
+		for _, key := range keys {
+			t.killKey("delrange", key)
+		}
+		return len(keys)
 	}
-	var deleted Item
-	hnew.Right, deleted, reclaim = deleteMaxCOW(hnew.Right, reclaim)
-
-	hnew, reclaim = fixUpCOW(hnew, reclaim)
-	return hnew, deleted, reclaim
+	root := t.Root()
+	from, till := rankRange(root, low, high, incl)
+	if till <= from {
+		return 0
+	}
+	t.written++
+	left, _, root, bh := splitTree(&t.algo, root, from, blackHeight(root))
+	root, _, right, _ := splitTree(&t.algo, root, till-from, bh)
+	t.reclaim = appendNodes(root, t.reclaim)
+	t.dropped += sizeOf(root)
+	root = concatTree(&t.algo, left, right)
+	t.publish("delrange", root)
+	t.count -= till - from
+	return till - from
 }
 
 // Delete deletes an key from the tree whose key equals key.
-// The deleted key is return, otherwise nil is returned.
+// The deleted key is return, otherwise nil is returned. If tree
+// allows duplicates, the first inserted element is deleted.
 func (t *LLRBMVCC) Delete(key Item) Item {
-	var deleted Item
-	reclaim := []*Node{}
-	root := t.Root()
-	root, deleted, reclaim = t.delete(root, key, reclaim)
-	t.reclaimNodes("delete", reclaim)
-	if root != nil {
-		root.Black = true
-	}
-	t.SetRoot(root)
+	t.mustWriter()
+	deleted := t.deleteKey(key)
 	if deleted != nil {
-		t.count--
+		t.logWrite(walDelete, key)
 	}
 	return deleted
 }
 
-func (t *LLRBMVCC) delete(
-	h *Node, key Item, reclaim []*Node) (*Node, Item, []*Node) {
-
-	var deleted Item
-	if h == nil {
-		return nil, nil, reclaim
+func (t *LLRBMVCC) deleteKey(key Item) Item {
+	if t.dups {
+		return t.deleteDuplicate(key, func(Item) bool { return true })
+	} else if t.tombs {
+		return t.killKey("delete", key)
 	}
+	root, removed := t.algo.Delete(t.tip(), key)
+	return t.removed("delete", root, removed)
+}
 
-	reclaim = append(reclaim, h)
-	hnew := cow(h)
+// DeleteDuplicate deletes the first element, in insertion order,
+// whose order is same as key and for which match returns true.
+// The deleted element is returned, otherwise nil is returned.
+func (t *LLRBMVCC) DeleteDuplicate(key Item, match func(Item) bool) Item {
+	t.mustWriter()
+	deleted := t.deleteDuplicate(key, match)
+	if deleted != nil {
+		t.logWrite(walDeleteItem, deleted)
+	}
+	return deleted
+}
 
-	if key.Less(hnew.Item) {
-		if hnew.Left == nil { // key not present. Nothing to delete
-			return hnew, nil, reclaim
-		}
-		if !isRed(hnew.Left) && !isRed(hnew.Left.Left) {
-			hnew, reclaim = moveRedLeftCOW(hnew, reclaim)
-		}
-		hnew.Left, deleted, reclaim = t.delete(hnew.Left, key, reclaim)
-	} else {
-		if isRed(hnew.Left) {
-			hnew, reclaim = rotateRightCOW(hnew, reclaim)
-		}
-		// If @key equals @hnew.Item and no right children at @hnew
-		if !hnew.Item.Less(key) && hnew.Right == nil {
-			return nil, hnew.Item, reclaim
-		}
-		// PETAR: Added 'hnew.Right != nil' below
-		if hnew.Right != nil && !isRed(hnew.Right) && !isRed(hnew.Right.Left) {
-			hnew, reclaim = moveRedRightCOW(hnew, reclaim)
-		}
-		// If @key equals @hnew.Item, and (from above) 'hnew.Right != nil'
-		if !hnew.Item.Less(key) {
-			var subDeleted Item
-			hnew.Right, subDeleted, reclaim = deleteMinCOW(hnew.Right, reclaim)
-			if subDeleted == nil {
-				panic("logic")
-			}
-			deleted, hnew.Item = hnew.Item, subDeleted
-		} else { // Else, @key is bigger than @hnew.Item
-			hnew.Right, deleted, reclaim = t.delete(hnew.Right, key, reclaim)
+func (t *LLRBMVCC) deleteDuplicate(key Item, match func(Item) bool) Item {
+	root := t.tip()
+	cur, i := newCursor(root), rankOf(root, key, false)
+	for cur.Seek(key); cur.Valid() && !key.Less(cur.Item()); cur.Next() {
+		if match(cur.Item()) {
+			root, removed := deleteAt(&t.algo, root, i)
+			return t.removed("delete", root, removed)
 		}
+		i++
 	}
-
-	hnew, reclaim = fixUpCOW(hnew, reclaim)
-	return hnew, deleted, reclaim
+	return nil
 }
 
 //----------------
@@ -434,7 +703,7 @@ func (t *LLRBMVCC) rangeFromFind(h *Node, low, high Item, iter KeyIterator) bool
 	if !t.rangeFromFind(h.Left, low, high, iter) {
 		return false
 	}
-	if iter != nil && !iter(h.Item) {
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
 		return false
 	}
 	return t.rangeFromFind(h.Right, low, high, iter)
@@ -454,7 +723,7 @@ func (t *LLRBMVCC) rangeFromTill(h *Node, low, high Item, iter KeyIterator) bool
 	if !t.rangeFromTill(h.Left, low, high, iter) {
 		return false
 	}
-	if iter != nil && !iter(h.Item) {
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
 		return false
 	}
 	return t.rangeFromTill(h.Right, low, high, iter)
@@ -474,7 +743,7 @@ func (t *LLRBMVCC) rangeAfterFind(h *Node, low, high Item, iter KeyIterator) boo
 	if !t.rangeAfterFind(h.Left, low, high, iter) {
 		return false
 	}
-	if iter != nil && !iter(h.Item) {
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
 		return false
 	}
 	return t.rangeAfterFind(h.Right, low, high, iter)
@@ -494,12 +763,107 @@ func (t *LLRBMVCC) rangeAfterTill(h *Node, low, high Item, iter KeyIterator) boo
 	if !t.rangeAfterTill(h.Left, low, high, iter) {
 		return false
 	}
-	if iter != nil && !iter(h.Item) {
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
 		return false
 	}
 	return t.rangeAfterTill(h.Right, low, high, iter)
 }
 
+// ReverseRange is same as Range, except that elements are
+// iterated from high-key to low-key.
+func (t *LLRBMVCC) ReverseRange(low, high Item, incl string, iter KeyIterator) {
+	switch incl {
+	case "both":
+		t.reverseFromFind(t.Root(), low, high, iter)
+	case "high":
+		t.reverseAfterFind(t.Root(), low, high, iter)
+	case "low":
+		t.reverseFromTill(t.Root(), low, high, iter)
+	default:
+		t.reverseAfterTill(t.Root(), low, high, iter)
+	}
+}
+
+// high >= (keys) >= low
+func (t *LLRBMVCC) reverseFromFind(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && high.Less(h.Item) {
+		return t.reverseFromFind(h.Left, low, high, iter)
+	}
+	if low != nil && h.Item.Less(low) {
+		return t.reverseFromFind(h.Right, low, high, iter)
+	}
+	if !t.reverseFromFind(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
+		return false
+	}
+	return t.reverseFromFind(h.Left, low, high, iter)
+}
+
+// high > (keys) >= low
+func (t *LLRBMVCC) reverseFromTill(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && !h.Item.Less(high) {
+		return t.reverseFromTill(h.Left, low, high, iter)
+	}
+	if low != nil && h.Item.Less(low) {
+		return t.reverseFromTill(h.Right, low, high, iter)
+	}
+	if !t.reverseFromTill(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
+		return false
+	}
+	return t.reverseFromTill(h.Left, low, high, iter)
+}
+
+// high >= (keys) > low
+func (t *LLRBMVCC) reverseAfterFind(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && high.Less(h.Item) {
+		return t.reverseAfterFind(h.Left, low, high, iter)
+	}
+	if low != nil && !low.Less(h.Item) {
+		return t.reverseAfterFind(h.Right, low, high, iter)
+	}
+	if !t.reverseAfterFind(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
+		return false
+	}
+	return t.reverseAfterFind(h.Left, low, high, iter)
+}
+
+// high > (keys) > low
+func (t *LLRBMVCC) reverseAfterTill(h *Node, low, high Item, iter KeyIterator) bool {
+	if h == nil {
+		return true
+	}
+	if high != nil && !h.Item.Less(high) {
+		return t.reverseAfterTill(h.Left, low, high, iter)
+	}
+	if low != nil && !low.Less(h.Item) {
+		return t.reverseAfterTill(h.Right, low, high, iter)
+	}
+	if !t.reverseAfterTill(h.Right, low, high, iter) {
+		return false
+	}
+	if iter != nil && !h.Meta.dead && !iter(h.Item) {
+		return false
+	}
+	return t.reverseAfterTill(h.Left, low, high, iter)
+}
+
 //--------------------
 // statistic operation
 //--------------------
@@ -529,156 +893,273 @@ func (t *LLRBMVCC) CowStats(opname string) (avg, stddev float64) {
 // copy on write operation
 //------------------------
 
-func cow(h *Node) *Node {
+// cow copies node h into a node allocated from heap, the copy is
+// extended if h is extended or if ext is true.
+func cow(h *Node, ext bool) *Node {
 	if h == nil {
 		return h
 	}
-	hnew := &Node{
-		Item:  h.Item,
-		Left:  h.Left,
-		Right: h.Right,
-		Black: h.Black,
+	var hnew *Node
+	if h.Meta.ext {
+		x := *(*nodeX)(unsafe.Pointer(h))
+		hnew = &x.Node
+	} else if ext {
+		x := &nodeX{Node: *h}
+		x.Meta.ext, hnew = true, &x.Node
+	} else {
+		n := *h
+		hnew = &n
 	}
+	hnew.Meta.gen = 0 // allocated from heap
 	return hnew
 }
 
-func rotateLeftCOW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	reclaim = append(reclaim, hnew.Right)
-	y := cow(hnew.Right)
-	if y.Black {
-		panic("rotating a black link")
+// own copies node h before it is modified by the write in progress,
+// h is reclaimed once the write is published.
+func (t *LLRBMVCC) own(h *Node) *Node {
+	if hnew := t.cow(h); hnew != h {
+		t.reclaim = append(t.reclaim, h)
+		return hnew
 	}
-	hnew.Right = y.Left
-	y.Left = hnew
-	y.Black = hnew.Black
-	hnew.Black = false
-	return y, reclaim
+	return h
 }
 
-func rotateRightCOW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	reclaim = append(reclaim, hnew.Left)
-	x := cow(hnew.Left)
-	if x.Black {
-		panic("rotating a black link")
+// replaceAtCOW replaces the i-th element in the sub-tree rooted
+// at h with key, and returns the replaced element.
+func (t *LLRBMVCC) replaceAtCOW(h *Node, i int, key Item) (*Node, Item) {
+	var replaced Item
+
+	hnew := t.own(h)
+
+	switch l := countOf(hnew.Left); {
+	case i < l:
+		hnew.Left, replaced = t.replaceAtCOW(hnew.Left, i, key)
+	case i > l:
+		hnew.Right, replaced = t.replaceAtCOW(hnew.Right, i-l-1, key)
+	default:
+		replaced, hnew.Item = hnew.Item, key
+		t.drop(replaced)
+		t.stamp(hnew)
 	}
-	hnew.Left = x.Right
-	x.Right = hnew
-	x.Black = hnew.Black
-	hnew.Black = false
-	return x, reclaim
+	t.algo.Update(hnew)
+	return hnew, replaced
 }
 
-// REQUIRE: Left and Right children must be present
-func flipCOW(hnew *Node, reclaim []*Node) []*Node {
-	reclaim = append(reclaim, hnew.Left, hnew.Right)
-	x, y := cow(hnew.Left), cow(hnew.Right)
-	x.Black = !x.Black
-	y.Black = !y.Black
-	hnew.Black, hnew.Left, hnew.Right = !hnew.Black, x, y
-	return reclaim
+//-------------
+// snapshotting
+//-------------
+
+// RSnapshot is same as RSnapshotContext with a background context.
+// timeout is unused, it is retained for compatibility, since
+// acquiring a snapshot never waits.
+func (t *LLRBMVCC) RSnapshot(timeout int) Snapshot {
+	snapshot, _ := t.RSnapshotContext(context.Background())
+	return snapshot
 }
 
-// REQUIRE: Left and Right children must be present
-func moveRedLeftCOW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	reclaim = flipCOW(hnew, reclaim)
-	if isRed(hnew.Right.Left) {
-		hnew.Right, reclaim = rotateRightCOW(hnew.Right, reclaim)
-		hnew, reclaim = rotateLeftCOW(hnew, reclaim)
-		reclaim = flipCOW(hnew, reclaim)
+// RSnapshotContext returns a snapshot of the tree that won't be
+// disturbed by future writes. Number of snapshots is not limited,
+// and acquiring a snapshot is wait-free, returns ctx.Err() only if
+// ctx is already done. Can be called by any goroutine, concurrently
+// with the writer.
+func (t *LLRBMVCC) RSnapshotContext(ctx context.Context) (Snapshot, error) {
+	if t.reader != nil {
+		panic("cannot create snapshot on writer's root")
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return hnew, reclaim
+
+	// root is loaded after entering the epoch, nodes reachable
+	// from it are not recycled until this snapshot is released.
+	// Writer publishes seqno after the root, hence seqno is loaded
+	// before the root.
+	e, r := t.enter()
+	seqno := atomic.LoadUint64(&t.seqno)
+	root := t.Root()
+	reader := &LLRBMVCC{
+		root:      unsafe.Pointer(root),
+		count:     countOf(root),
+		dups:      t.dups,
+		tombs:     t.tombs,
+		intervals: t.intervals,
+		agg:       t.agg,
+		seqno:     seqno,
+		reader:    e,
+		record:    r,
+		writer:    t,
+	}
+	return reader, nil
 }
 
-// REQUIRE: Left and Right children must be present
-func moveRedRightCOW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	reclaim = flipCOW(hnew, reclaim)
-	if isRed(hnew.Left.Left) {
-		hnew, reclaim = rotateRightCOW(hnew, reclaim)
-		reclaim = flipCOW(hnew, reclaim)
+// Release implements Snapshot interface, returns ErrNotSnapshot if
+// called on the writer and ErrExpired if the snapshot was expired
+// by the writer. Release is wait-free.
+func (t *LLRBMVCC) Release() error {
+	if t.reader == nil {
+		return ErrNotSnapshot
+	} else if atomic.CompareAndSwapInt32(&t.released, 0, 1) {
+		if t.record != nil {
+			atomic.StoreInt32(&t.record.released, 1)
+		}
+		atomic.AddUint64(&t.reader.left, 1)
+	} else if atomic.LoadInt32(&t.reader.expired) == 0 {
+		return ErrReleased
+	}
+	if atomic.LoadInt32(&t.reader.expired) == 1 {
+		return ErrExpired
 	}
-	return hnew, reclaim
+	return nil
 }
 
-func fixUpCOW(hnew *Node, reclaim []*Node) (*Node, []*Node) {
-	if isRed(hnew.Right) {
-		hnew, reclaim = rotateLeftCOW(hnew, reclaim)
-	}
+// ReleaseSnapshot is same as Release, ignoring the error.
+//
+// Deprecated: use Release.
+func (t *LLRBMVCC) ReleaseSnapshot() {
+	t.Release()
+}
 
-	if isRed(hnew.Left) && isRed(hnew.Left.Left) {
-		hnew, reclaim = rotateRightCOW(hnew, reclaim)
+func (t *LLRBMVCC) mustWriter() {
+	if t.reader != nil {
+		panic("cannot write into snapshot")
 	}
+}
 
-	if isRed(hnew.Left) && isRed(hnew.Right) {
-		reclaim = flipCOW(hnew, reclaim)
+// reclaimNodes holds nodes, reclaimed by a write, until the
+// snapshots that can reach them are released. Nodes are recycled
+// straight away if there are no snapshots. Shall be called after
+// the write is published by SetRoot.
+func (t *LLRBMVCC) reclaimNodes(opname string, reclaim []*Node) {
+	t.reclaimstats[opname].Add(float64(len(reclaim)))
+	t.checkExpiry()
+	dropped := t.dropped
+	t.dropped = 0
+	if len(reclaim) == 0 {
+		return
+	}
+	t.closeEpoch()
+	if len(t.snapshots) > 0 && t.snapshots[0].released() {
+		t.setSnapshots(t.gc())
+	}
+	if m := len(t.snapshots); m == 0 {
+		t.recycle(reclaim)
+	} else {
+		t.snapshots[m-1].hold(reclaim, int64(dropped))
 	}
-
-	return hnew, reclaim
 }
 
-//-------------
-// snapshotting
-//-------------
+// drop accounts for item removed from the tree by the write in
+// progress, it is held by snapshots if any.
+func (t *LLRBMVCC) drop(item Item) {
+	t.dropped += item.Size()
+}
 
-func (t *LLRBMVCC) RSnapshot(timeout int) MemStore {
-	if t.reader != nil {
-		panic("cannot create snapshot on writer's root")
+// closeEpoch closes the current epoch if any reader entered it,
+// nodes reclaimed hereafter are held for its readers.
+func (t *LLRBMVCC) closeEpoch() {
+	if e := t.advance(); e != nil {
+		r := newReclaimed(e)
+		r.seqno = e.seqno
+		t.setSnapshots(append(t.snapshots, r))
 	}
-	select {
-	case t.sync <- true:
-		if (t.count_snaps % 1000) == 0 {
-			t.snapshots = t.gc()
-		}
+}
 
-	default:
-		tm := time.After(time.Duration(timeout) * time.Millisecond)
-		select {
-		case t.sync <- true:
-		case <-tm:
-			log.Fatalf("snapshot timeout")
-			return nil
+// pending closes the current epoch and drops released snapshots,
+// returns snapshots that are not released.
+func (t *LLRBMVCC) pending() []*reclaimed {
+	t.closeEpoch()
+	t.setSnapshots(t.gc())
+	return t.snapshots
+}
+
+// setSnapshots sets the snapshots of the tree, waiting for release,
+// and publishes them for Stats.
+func (t *LLRBMVCC) setSnapshots(snapshots []*reclaimed) {
+	t.snapshots = snapshots
+	atomic.StorePointer(&t.held, unsafe.Pointer(&snapshots))
+}
+
+// gc drops released snapshots. Nodes reclaimed while a released
+// snapshot was the latest can still be reached by older snapshots,
+// hence they are handed over to the previous snapshot that is not
+// released, and are recycled if there is none. Shall be called by
+// the writer.
+func (t *LLRBMVCC) gc() []*reclaimed {
+	snapshots := make([]*reclaimed, 0, len(t.snapshots))
+	for _, r := range t.snapshots {
+		if !r.released() {
+			snapshots = append(snapshots, r)
+		} else if n := len(snapshots); n > 0 {
+			snapshots[n-1].hold(r.nodes, atomic.LoadInt64(&r.bytes))
+		} else {
+			t.recycle(r.nodes)
 		}
-		t.snapshots = t.gc()
 	}
+	return snapshots
+}
 
-	// prepare a new reader
-	ch := make(chan bool, 1)
-	t.snapshots = append(t.snapshots, [2]interface{}{ch, make([]*Node, 0)})
-	reader := &LLRBMVCC{
-		root:   unsafe.Pointer(t.Root()),
-		count:  t.count,
-		size:   t.size,
-		reader: ch,
-		writer: t,
+// recycle returns nodes, that cannot be reached by the tree or by
+// any of its snapshots, to the node pool.
+func (t *LLRBMVCC) recycle(nodes []*Node) {
+	for _, h := range nodes {
+		t.pool.free(h)
 	}
-	t.count_snaps++
-	return reader
 }
 
-func (t *LLRBMVCC) ReleaseSnapshot() {
-	close(t.reader)
-	<-t.writer.sync
+// handover removes the snapshots of this tree that are not
+// released, along with the nodes waiting for them, and returns
+// them as a single entry. Used when nodes of this tree are moved
+// to other trees.
+func (t *LLRBMVCC) handover() *reclaimed {
+	r := newReclaimed()
+	for _, snapshot := range t.pending() {
+		r.epochs = append(r.epochs, snapshot.epochs...)
+		r.hold(snapshot.nodes, atomic.LoadInt64(&snapshot.bytes))
+	}
+	t.setSnapshots(make([]*reclaimed, 0))
+	return r
 }
 
-func (t *LLRBMVCC) reclaimNodes(opname string, reclaim []*Node) {
-	t.reclaimstats[opname].Add(float64(len(reclaim)))
-	if m, n := len(t.snapshots), len(reclaim); m == 0 && n > 0 {
-		// TODO: put []*Node back to sync.Pool
-	} else if n > 0 {
-		nodes := t.snapshots[m-1][1].([]*Node)
-		nodes = append(nodes, reclaim...)
-		t.snapshots[m-1][1] = nodes
+// pin makes nodes reclaimed by this tree wait for snapshots in r,
+// which are snapshots of other trees sharing nodes with this tree.
+func (t *LLRBMVCC) pin(r *reclaimed) {
+	if len(r.epochs) == 0 {
+		t.recycle(r.nodes)
+		return
 	}
+	r.pinned = true
+	t.setSnapshots(append(t.snapshots, r))
 }
 
-func (t *LLRBMVCC) gc() [][2]interface{} {
-	snapshots := make([][2]interface{}, 0, len(t.snapshots))
-	for _, rd := range t.snapshots {
-		select {
-		case <-rd[0].(chan bool):
-			// TODO: put rd[1].([]*Node) back to sync.Pool
-		default:
-			snapshots = append(snapshots, rd)
+// reclaimed holds nodes reclaimed from the tree while an epoch is
+// the latest closed epoch. Trees created by Split and Join wait for
+// several epochs of the trees they share nodes with, and their
+// seqno is zero.
+type reclaimed struct {
+	epochs []*epoch
+	nodes  []*Node
+	nnodes int64  // len(nodes), loaded by Stats
+	bytes  int64  // bytes of items, held by nodes, removed from the tree
+	seqno  uint64 // seqno of the tree when epoch started
+	pinned bool   // epochs are of other trees
+}
+
+func newReclaimed(epochs ...*epoch) *reclaimed {
+	return &reclaimed{epochs: epochs, nodes: make([]*Node, 0)}
+}
+
+// hold adds nodes, along with bytes of their items removed from the
+// tree, to r.
+func (r *reclaimed) hold(nodes []*Node, bytes int64) {
+	r.nodes = append(r.nodes, nodes...)
+	atomic.AddInt64(&r.nnodes, int64(len(nodes)))
+	atomic.AddInt64(&r.bytes, bytes)
+}
+
+func (r *reclaimed) released() bool {
+	for _, e := range r.epochs {
+		if !e.drained() {
+			return false
 		}
 	}
-	return snapshots
+	return true
 }
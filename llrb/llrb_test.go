@@ -1,10 +1,22 @@
 package llrb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 var _ = fmt.Sprintf("dummpy print")
@@ -85,6 +97,67 @@ func TestRange(t *testing.T) {
 	})
 }
 
+func TestReverseRange(t *testing.T) {
+	d, n := NewDict(), 100
+	stores := []MemStore{NewLLRB(), NewLLRBMVCC(0)}
+	for _, i := range rand.Perm(n) {
+		d.Upsert(&KeyInt{int64(i), -1})
+		for _, store := range stores {
+			store.Upsert(&KeyInt{int64(i), -1})
+		}
+	}
+	bounds := [][2]Item{
+		{nil, nil},
+		{&KeyInt{10, -1}, nil},
+		{nil, &KeyInt{90, -1}},
+		{&KeyInt{10, -1}, &KeyInt{90, -1}},
+		{&KeyInt{10, -1}, &KeyInt{10, -1}},
+		{&KeyInt{90, -1}, &KeyInt{10, -1}},
+	}
+	collect := func(fn func(low, high Item, incl string, iter KeyIterator),
+		low, high Item, incl string) []int64 {
+
+		keys := make([]int64, 0)
+		fn(low, high, incl, func(key Item) bool {
+			keys = append(keys, key.(*KeyInt).Key)
+			return true
+		})
+		return keys
+	}
+	for _, incl := range []string{"both", "low", "high", "none"} {
+		for _, bound := range bounds {
+			ref := collect(d.ReverseRange, bound[0], bound[1], incl)
+			fwd := collect(d.Range, bound[0], bound[1], incl)
+			if len(ref) != len(fwd) {
+				t.Fatalf("%v %v expected %v, got %v", incl, bound, fwd, ref)
+			}
+			for i := range ref {
+				if ref[i] != fwd[len(fwd)-1-i] {
+					t.Fatalf("%v %v expected %v, got %v", incl, bound, fwd, ref)
+				}
+			}
+			for _, store := range stores {
+				keys := collect(store.ReverseRange, bound[0], bound[1], incl)
+				if !reflect.DeepEqual(ref, keys) {
+					t.Fatalf("%v %v expected %v, got %v", incl, bound, ref, keys)
+				}
+			}
+		}
+	}
+	// early exit
+	count := 0
+	stores[0].ReverseRange(nil, nil, "both", func(key Item) bool {
+		if key.(*KeyInt).Key != int64(n-1-count) {
+			t.Fatalf("expected %v, got %v", n-1-count, key)
+		}
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("expected 10 items, got %v", count)
+	}
+}
+
 func TestRandomInsertOrder(t *testing.T) {
 	tree := NewLLRB()
 	n := 1000
@@ -200,6 +273,7 @@ func TestRandomInsertStats(t *testing.T) {
 
 func TestInsertNoReplace(t *testing.T) {
 	tree := NewLLRB()
+	tree.SetDuplicates(true)
 	n := 1000
 	for q := 0; q < 2; q++ {
 		perm := rand.Perm(n)
@@ -217,6 +291,2550 @@ func TestInsertNoReplace(t *testing.T) {
 	})
 }
 
+func TestCursor(t *testing.T) {
+	tree := NewLLRB()
+	n := 1000
+	perm := rand.Perm(n)
+	for i := 0; i < n; i++ {
+		tree.Upsert(&KeyInt{int64(perm[i] * 2), -1})
+	}
+	cur := tree.Cursor()
+	for i := 0; i < n; i++ {
+		if !cur.Valid() || cur.Item().(*KeyInt).Key != int64(i*2) {
+			t.Fatalf("expected %v, got %v", i*2, cur.Item())
+		}
+		cur.Next()
+	}
+	if cur.Valid() {
+		t.Fatalf("expected cursor to be exhausted")
+	}
+	cur.Last()
+	for i := n - 1; i >= 0; i-- {
+		if !cur.Valid() || cur.Item().(*KeyInt).Key != int64(i*2) {
+			t.Fatalf("expected %v, got %v", i*2, cur.Item())
+		}
+		cur.Prev()
+	}
+	if cur.Valid() {
+		t.Fatalf("expected cursor to be exhausted")
+	}
+	// seek on missing and present keys
+	cur.Seek(&KeyInt{501, -1})
+	if item := cur.Item().(*KeyInt); item.Key != 502 {
+		t.Fatalf("expected 502, got %v", item.Key)
+	}
+	if item := cur.Prev().(*KeyInt); item.Key != 500 {
+		t.Fatalf("expected 500, got %v", item.Key)
+	}
+	cur.Seek(&KeyInt{500, -1})
+	if item := cur.Next().(*KeyInt); item.Key != 502 {
+		t.Fatalf("expected 502, got %v", item.Key)
+	}
+	if cur.Seek(&KeyInt{int64(n * 2), -1}); cur.Valid() {
+		t.Fatalf("expected invalid cursor")
+	}
+	if cur.Seek(&KeyInt{-10, -1}); cur.Item().(*KeyInt).Key != 0 {
+		t.Fatalf("expected 0, got %v", cur.Item())
+	}
+}
+
+func TestCursorSnapshot(t *testing.T) {
+	tree := NewLLRBMVCC(0)
+	n := 100
+	for i := 0; i < n; i++ {
+		tree.Upsert(&KeyInt{int64(i), -1})
+	}
+	snapshot := tree.RSnapshot(100)
+	cur := snapshot.Cursor()
+	for i := 0; i < n; i++ {
+		tree.Delete(&KeyInt{int64(i), -1})
+		tree.Upsert(&KeyInt{int64(i + n), -1})
+	}
+	i := 0
+	for ; cur.Valid(); cur.Next() {
+		if cur.Item().(*KeyInt).Key != int64(i) {
+			t.Fatalf("expected %v, got %v", i, cur.Item())
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %v items, got %v", n, i)
+	}
+	snapshot.Release()
+}
+
+func TestOrderStatistics(t *testing.T) {
+	for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+		d, n := NewDict(), 1000
+		for _, i := range rand.Perm(n) {
+			d.Upsert(&KeyInt{int64(i * 2), -1})
+			store.Upsert(&KeyInt{int64(i * 2), -1})
+		}
+		for i := 0; i < n/2; i++ {
+			store.DeleteMin()
+			d.DeleteMin()
+			x := &KeyInt{int64(rand.Intn(n * 2)), -1}
+			store.Delete(x)
+			d.Delete(x)
+			x = &KeyInt{int64(rand.Intn(n * 4)), -1}
+			store.Upsert(x)
+			d.Upsert(x)
+		}
+		ostat := store.(interface {
+			Rank(key Item) int
+			Select(i int) Item
+			CountRange(low, high Item, incl string) int
+		})
+		if c := validateTree(t, rootOf(store)); c != store.Len() || c != d.Len() {
+			t.Fatalf("expected %v nodes, got %v", d.Len(), c)
+		}
+
+		i := 0
+		d.Range(nil, nil, "both", func(key Item) bool {
+			if r := ostat.Rank(key); r != i {
+				t.Fatalf("expected rank %v, got %v", i, r)
+			}
+			if item := ostat.Select(i); item.(*KeyInt).Key != key.(*KeyInt).Key {
+				t.Fatalf("expected %v, got %v", key, item)
+			}
+			i++
+			return true
+		})
+		if ostat.Select(-1) != nil || ostat.Select(d.Len()) != nil {
+			t.Fatalf("expected nil for out of range select")
+		}
+		for j := 0; j < 100; j++ {
+			low := &KeyInt{int64(rand.Intn(n * 4)), -1}
+			high := &KeyInt{int64(rand.Intn(n * 4)), -1}
+			for _, incl := range []string{"both", "low", "high", "none"} {
+				ref := 0
+				d.Range(low, high, incl, func(Item) bool { ref++; return true })
+				if c := ostat.CountRange(low, high, incl); c != ref {
+					t.Fatalf("%v %v %v expected %v, got %v", low, high, incl, ref, c)
+				}
+			}
+		}
+		if c := ostat.CountRange(nil, nil, "none"); c != d.Len() {
+			t.Fatalf("expected %v, got %v", d.Len(), c)
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for n := 0; n < 300; n++ {
+		for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+			keys := make([]Item, 0, n)
+			for i := 0; i < n; i++ {
+				keys = append(keys, &KeyInt{int64(i), -1})
+			}
+			store.InsertBulk(keys...)
+			if store.Len() != n {
+				t.Fatalf("expected %v, got %v", n, store.Len())
+			}
+			validateTree(t, rootOf(store))
+		}
+	}
+	for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+		d := NewDict()
+		for _, i := range rand.Perm(1000) {
+			d.Upsert(&KeyInt{int64(i * 3), -1})
+			store.Upsert(&KeyInt{int64(i * 3), -1})
+		}
+		// sorted batch with keys overlapping the tree and with
+		// adjacent duplicates, later key shall win.
+		keys := make([]Item, 0)
+		for i := 0; i < 2000; i++ {
+			keys = append(keys, &KeyInt{int64(i * 2), int64(i)})
+			if i%10 == 0 {
+				keys = append(keys, &KeyInt{int64(i * 2), int64(-i)})
+			}
+		}
+		d.UpsertBulk(keys...)
+		store.UpsertBulk(keys...)
+		validateTree(t, rootOf(store))
+		if store.Len() != d.Len() {
+			t.Fatalf("expected %v, got %v", d.Len(), store.Len())
+		}
+		refs, items := make([]Item, 0), make([]Item, 0)
+		d.Range(nil, nil, "both", func(key Item) bool {
+			refs = append(refs, key)
+			return true
+		})
+		store.Range(nil, nil, "both", func(key Item) bool {
+			items = append(items, key)
+			return true
+		})
+		if !reflect.DeepEqual(refs, items) {
+			t.Fatalf("mismatch after bulk upsert")
+		}
+	}
+}
+
+// values is the aggregate of trees, in tests, that are configured
+// with one.
+var values = &aggregator{of: AggregateValue, combine: CombineValues}
+
+// validateTree checks for LLRB invariants and returns the number
+// of nodes in the tree.
+func validateTree(t *testing.T, root *Node) int {
+	if isRed(root) {
+		t.Fatalf("root must be black")
+	}
+	var prev Item
+	var walk func(h *Node) (count, blacks int)
+	walk = func(h *Node) (int, int) {
+		if h == nil {
+			return 0, 1
+		}
+		if isRed(h.Right) {
+			t.Fatalf("right leaning red link at %v", h.Item)
+		} else if isRed(h) && isRed(h.Left) {
+			t.Fatalf("consecutive red links at %v", h.Item)
+		}
+		lcount, lblacks := walk(h.Left)
+		if prev != nil && h.Item.Less(prev) {
+			t.Fatalf("%v is out of order", h.Item)
+		}
+		prev = h.Item
+		rcount, rblacks := walk(h.Right)
+		if lblacks != rblacks {
+			t.Fatalf("unbalanced black height at %v", h.Item)
+		}
+		count, size := lcount+rcount, sizeOf(h.Left)+sizeOf(h.Right)
+		if !h.Meta.dead {
+			count, size = count+1, size+h.Item.Size()
+		}
+		if h.Meta.count != count {
+			t.Fatalf("expected count %v, got %v", count, h.Meta.count)
+		} else if h.Meta.size != size {
+			t.Fatalf("expected size %v, got %v", size, h.Meta.size)
+		}
+		// only extended nodes keep maxend and aggregate.
+		x := &extension{}
+		if h.Meta.ext {
+			x = extOf(h)
+		}
+		if iv, ok := h.Item.(Interval); ok && h.Meta.ext {
+			var maxend Interval
+			if !h.Meta.dead {
+				maxend = iv
+			}
+			for _, child := range []*Node{h.Left, h.Right} {
+				if child == nil || extOf(child).maxend == nil {
+					continue
+				} else if maxend == nil || maxend.EndLess(extOf(child).maxend) {
+					maxend = extOf(child).maxend
+				}
+			}
+			if maxend != x.maxend {
+				t.Fatalf("expected maxend %v, got %v", maxend, x.maxend)
+			}
+		}
+		// trees with an aggregate, in tests, summarise values.
+		aggOf := func(h *Node) Aggregate {
+			if h == nil || !h.Meta.ext {
+				return nil
+			}
+			return extOf(h).agg
+		}
+		if left, right := aggOf(h.Left), aggOf(h.Right); x.agg != nil || left != nil || right != nil {
+			agg := values.with(h, left, right)
+			if !reflect.DeepEqual(agg, x.agg) {
+				t.Fatalf("expected aggregate %v, got %v", agg, x.agg)
+			}
+		}
+		if h.Black {
+			lblacks++
+		}
+		return count, lblacks
+	}
+	count, _ := walk(root)
+	return count
+}
+
+func rootOf(store Snapshot) *Node {
+	switch tree := store.(type) {
+	case *LLRB:
+		return tree.Root()
+	case *LLRBMVCC:
+		return tree.Root()
+	}
+	return nil
+}
+
+func TestDuplicates(t *testing.T) {
+	trees := []MemStore{NewLLRB(), NewLLRBMVCC(0)}
+	trees[0].(*LLRB).SetDuplicates(true)
+	trees[1].(*LLRBMVCC).SetDuplicates(true)
+	for _, store := range trees {
+		tree := store.(interface {
+			GetAll(key Item) []Item
+			DeleteDuplicate(key Item, match func(Item) bool) Item
+		})
+		n, dups := 100, 10
+		for j := 0; j < dups; j++ {
+			for _, i := range rand.Perm(n) {
+				store.Insert(&KeyInt{int64(i), int64(j)})
+			}
+		}
+		if store.Len() != n*dups {
+			t.Fatalf("expected %v, got %v", n*dups, store.Len())
+		}
+		validateTree(t, rootOf(store))
+		for i := 0; i < n; i++ {
+			items := tree.GetAll(&KeyInt{int64(i), -1})
+			if len(items) != dups {
+				t.Fatalf("expected %v duplicates, got %v", dups, len(items))
+			}
+			for j, item := range items {
+				if kint := item.(*KeyInt); kint.Key != int64(i) || kint.Value != int64(j) {
+					t.Fatalf("expected {%v %v}, got %v", i, j, kint)
+				}
+			}
+		}
+		count := 0
+		store.Range(&KeyInt{10, -1}, &KeyInt{20, -1}, "low", func(Item) bool {
+			count++
+			return true
+		})
+		if count != 10*dups {
+			t.Fatalf("expected %v, got %v", 10*dups, count)
+		}
+
+		key := &KeyInt{5, -1}
+		if item := store.Get(key).(*KeyInt); item.Value != 0 {
+			t.Fatalf("expected first duplicate, got %v", item)
+		}
+		if item := store.Delete(key).(*KeyInt); item.Value != 0 {
+			t.Fatalf("expected first duplicate, got %v", item)
+		}
+		if item := store.Upsert(&KeyInt{5, 100}).(*KeyInt); item.Value != 1 {
+			t.Fatalf("expected first duplicate, got %v", item)
+		}
+		item := tree.DeleteDuplicate(key, func(item Item) bool {
+			return item.(*KeyInt).Value == 5
+		})
+		if item.(*KeyInt).Value != 5 {
+			t.Fatalf("expected {5 5}, got %v", item)
+		}
+		item = tree.DeleteDuplicate(key, func(item Item) bool {
+			return item.(*KeyInt).Value == 5
+		})
+		if item != nil {
+			t.Fatalf("unexpected %v", item)
+		}
+		values := []int64{100, 2, 3, 4, 6, 7, 8, 9}
+		for i, item := range tree.GetAll(key) {
+			if item.(*KeyInt).Value != values[i] {
+				t.Fatalf("expected %v, got %v", values[i], item)
+			}
+		}
+		if store.Len() != n*dups-2 {
+			t.Fatalf("expected %v, got %v", n*dups-2, store.Len())
+		}
+		validateTree(t, rootOf(store))
+
+		// pre-sorted bulk insert retains duplicates.
+		keys := make([]Item, 0, n)
+		for i := 0; i < n; i++ {
+			keys = append(keys, &KeyInt{int64(i), int64(dups)})
+		}
+		store.InsertBulk(keys...)
+		validateTree(t, rootOf(store))
+		if items := tree.GetAll(&KeyInt{50, -1}); len(items) != dups+1 {
+			t.Fatalf("expected %v duplicates, got %v", dups+1, len(items))
+		} else if item := items[dups].(*KeyInt); item.Value != int64(dups) {
+			t.Fatalf("expected last duplicate, got %v", item)
+		}
+		for store.Len() > 0 {
+			store.Delete(&KeyInt{int64(rand.Intn(n)), -1})
+		}
+		validateTree(t, rootOf(store))
+	}
+}
+
+func TestUpsertFunc(t *testing.T) {
+	incr := func(old Item) (Item, bool) {
+		if old == nil {
+			return &KeyInt{10, 1}, true
+		}
+		kint := old.(*KeyInt)
+		return &KeyInt{kint.Key, kint.Value + 1}, true
+	}
+	abort := func(old Item) (Item, bool) { return nil, false }
+
+	writer := NewLLRBMVCC(0)
+	for _, store := range []MemStore{NewLLRB(), writer} {
+		for i := int64(0); i < 100; i += 2 {
+			store.Upsert(&KeyInt{i, 0})
+		}
+		snapshot := store.RSnapshot(10)
+		root := rootOf(store)
+		if old := store.UpsertFunc(&KeyInt{11, 0}, abort); old != nil {
+			t.Fatalf("expected nil, got %v", old)
+		} else if store.Len() != 50 || rootOf(store) != root {
+			t.Fatalf("expected tree to be untouched")
+		}
+		for i := 0; i < 5; i++ {
+			store.UpsertFunc(&KeyInt{10, 0}, incr)
+		}
+		if item := store.Get(&KeyInt{10, 0}); item.(*KeyInt).Value != 5 {
+			t.Fatalf("expected 5, got %v", item)
+		} else if store.UpsertFunc(&KeyInt{10, 0}, abort) != item {
+			t.Fatalf("expected %v", item)
+		}
+		store.UpsertFunc(&KeyInt{11, 0}, func(old Item) (Item, bool) {
+			return &KeyInt{11, 7}, old == nil
+		})
+		if store.Len() != 51 {
+			t.Fatalf("expected 51, got %v", store.Len())
+		}
+		validateTree(t, rootOf(store))
+		if item := snapshot.Get(&KeyInt{10, 0}); item.(*KeyInt).Value != 0 {
+			t.Fatalf("expected snapshot to be untouched, got %v", item)
+		} else if snapshot.Has(&KeyInt{11, 0}) {
+			t.Fatalf("expected snapshot to be untouched")
+		}
+		snapshot.Release()
+
+		// compare and swap
+		old := store.Get(&KeyInt{20, 0})
+		if store.CompareAndSwap(&KeyInt{20, 0}, &KeyInt{20, 1}) {
+			t.Fatalf("expected swap to fail for a different item")
+		} else if !store.CompareAndSwap(old, &KeyInt{20, 1}) {
+			t.Fatalf("expected swap to succeed")
+		} else if store.CompareAndSwap(old, &KeyInt{20, 2}) {
+			t.Fatalf("expected swap to fail for a replaced item")
+		} else if store.CompareAndSwap(nil, &KeyInt{20, 2}) {
+			t.Fatalf("expected swap to fail for a present key")
+		} else if !store.CompareAndSwap(nil, &KeyInt{21, 2}) {
+			t.Fatalf("expected swap to insert an absent key")
+		}
+		if item := store.Get(&KeyInt{20, 0}); item.(*KeyInt).Value != 1 {
+			t.Fatalf("expected 1, got %v", item)
+		} else if store.Len() != 52 {
+			t.Fatalf("expected 52, got %v", store.Len())
+		}
+		validateTree(t, rootOf(store))
+	}
+
+	// compare and swap among duplicates.
+	for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+		store.(interface{ SetDuplicates(bool) }).SetDuplicates(true)
+		for i := int64(0); i < 5; i++ {
+			store.Insert(&KeyInt{1, i})
+		}
+		items := store.(interface{ GetAll(Item) []Item }).GetAll(&KeyInt{1, 0})
+		if !store.CompareAndSwap(items[3], &KeyInt{1, 30}) {
+			t.Fatalf("expected swap to succeed")
+		}
+		items = store.(interface{ GetAll(Item) []Item }).GetAll(&KeyInt{1, 0})
+		values := []int64{}
+		for _, item := range items {
+			values = append(values, item.(*KeyInt).Value)
+		}
+		if !reflect.DeepEqual(values, []int64{0, 1, 2, 30, 4}) {
+			t.Fatalf("unexpected %v", values)
+		}
+		validateTree(t, rootOf(store))
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	incls := []string{"both", "low", "high", "none"}
+	for _, dups := range []bool{false, true} {
+		writer := NewLLRBMVCC(0)
+		for _, store := range []MemStore{NewLLRB(), writer} {
+			store.(interface{ SetDuplicates(bool) }).SetDuplicates(dups)
+			keys := []int64{}
+			for i := 0; i < 2000; i++ {
+				key := rand.Int63n(1000)
+				if !dups && store.Has(&KeyInt{key, 0}) {
+					continue
+				}
+				store.Insert(&KeyInt{key, int64(i)})
+				keys = append(keys, key)
+			}
+			snapshot := store.RSnapshot(10)
+			count := store.Len()
+			ranger := store.(interface {
+				CountRange(low, high Item, incl string) int
+			})
+			for i := 0; i < 200; i++ {
+				var low, high Item
+				lkey, hkey := rand.Int63n(1100)-50, rand.Int63n(1100)-50
+				if i%10 != 1 {
+					low = &KeyInt{lkey, 0}
+				}
+				if i%10 != 2 {
+					high = &KeyInt{hkey, 0}
+				}
+				incl := incls[i%len(incls)]
+				ref := ranger.CountRange(low, high, incl)
+				if n := store.DeleteRange(low, high, incl); n != ref {
+					t.Fatalf("expected %v, got %v", ref, n)
+				} else if ranger.CountRange(low, high, incl) != 0 {
+					t.Fatalf("expected range %v %v %v to be empty", low, high, incl)
+				}
+				count -= ref
+				if store.Len() != count {
+					t.Fatalf("expected %v, got %v", count, store.Len())
+				} else if n := validateTree(t, rootOf(store)); n != count {
+					t.Fatalf("expected %v, got %v", count, n)
+				}
+				if store.Len() < 100 {
+					break
+				}
+			}
+			if snapshot.Len() != len(keys) {
+				t.Fatalf("expected %v, got %v", len(keys), snapshot.Len())
+			} else if n := validateTree(t, rootOf(snapshot)); n != len(keys) {
+				t.Fatalf("expected %v, got %v", len(keys), n)
+			}
+			snapshot.Release()
+			if n := store.DeleteRange(nil, nil, "none"); n != count {
+				t.Fatalf("expected %v, got %v", count, n)
+			} else if store.Len() != 0 || rootOf(store) != nil {
+				t.Fatalf("expected empty tree")
+			}
+		}
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	type setop func(a, b MemStore, conflict Conflict) MemStore
+	ops := map[string]setop{
+		"union": func(a, b MemStore, conflict Conflict) MemStore {
+			if tree, ok := a.(*LLRB); ok {
+				return tree.Union(b, conflict)
+			}
+			return a.(*LLRBMVCC).Union(b, conflict)
+		},
+		"intersection": func(a, b MemStore, conflict Conflict) MemStore {
+			if tree, ok := a.(*LLRB); ok {
+				return tree.Intersection(b, conflict)
+			}
+			return a.(*LLRBMVCC).Intersection(b, conflict)
+		},
+		"difference": func(a, b MemStore, conflict Conflict) MemStore {
+			if tree, ok := a.(*LLRB); ok {
+				return tree.Difference(b)
+			}
+			return a.(*LLRBMVCC).Difference(b)
+		},
+	}
+	sum := func(l, r Item) Item {
+		return &KeyInt{l.(*KeyInt).Key, l.(*KeyInt).Value + r.(*KeyInt).Value}
+	}
+	drop := func(l, r Item) Item { return nil }
+	conflicts := []Conflict{LeftWins, RightWins, sum, drop, nil}
+
+	// reference implementation over multisets, values of left and
+	// right trees are disjoint.
+	reference := func(name string, a, b []Item, conflict Conflict) []int64 {
+		counts := map[int64][2][]Item{}
+		for _, item := range a {
+			c := counts[item.(*KeyInt).Key]
+			c[0] = append(c[0], item)
+			counts[item.(*KeyInt).Key] = c
+		}
+		for _, item := range b {
+			c := counts[item.(*KeyInt).Key]
+			c[1] = append(c[1], item)
+			counts[item.(*KeyInt).Key] = c
+		}
+		keys := []int64{}
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		values := []int64{}
+		for _, key := range keys {
+			l, r := counts[key][0], counts[key][1]
+			for i := 0; i < len(l) || i < len(r); i++ {
+				var item Item
+				switch {
+				case i < len(l) && i < len(r) && name != "difference":
+					item = l[i]
+					if conflict != nil {
+						item = conflict(l[i], r[i])
+					}
+				case i < len(l) && i >= len(r) && name != "intersection":
+					item = l[i]
+				case i >= len(l) && name == "union":
+					item = r[i]
+				}
+				if item != nil {
+					values = append(values, item.(*KeyInt).Value)
+				}
+			}
+		}
+		return values
+	}
+
+	for _, dups := range []bool{false, true} {
+		for i, ctor := range []func() MemStore{
+			func() MemStore { return NewLLRB() },
+			func() MemStore { return NewLLRBMVCC(0) },
+		} {
+			a, b := ctor(), ctor()
+			a.(interface{ SetDuplicates(bool) }).SetDuplicates(dups)
+			b.(interface{ SetDuplicates(bool) }).SetDuplicates(dups)
+			aitems, bitems := []Item{}, []Item{}
+			for j := 0; j < 1000; j++ {
+				item := &KeyInt{rand.Int63n(500), int64(j)}
+				if j%2 == 0 {
+					a.Insert(item)
+				} else {
+					b.Insert(item)
+				}
+			}
+			a.Range(nil, nil, "both", func(item Item) bool {
+				aitems = append(aitems, item)
+				return true
+			})
+			b.Range(nil, nil, "both", func(item Item) bool {
+				bitems = append(bitems, item)
+				return true
+			})
+			for name, op := range ops {
+				for k, conflict := range conflicts {
+					ref := reference(name, aitems, bitems, conflict)
+					c := op(a, b, conflict)
+					values := []int64{}
+					c.Range(nil, nil, "both", func(item Item) bool {
+						values = append(values, item.(*KeyInt).Value)
+						return true
+					})
+					if !reflect.DeepEqual(values, ref) {
+						t.Fatalf("%v %v %v %v: expected %v, got %v",
+							dups, i, name, k, ref, values)
+					} else if c.Len() != len(ref) {
+						t.Fatalf("expected %v, got %v", len(ref), c.Len())
+					}
+					validateTree(t, rootOf(c))
+				}
+			}
+			if a.Len() != len(aitems) || b.Len() != len(bitems) {
+				t.Fatalf("expected inputs to be untouched")
+			}
+		}
+	}
+
+	// other operand can be a snapshot, or any other store.
+	tree, writer := NewLLRB(), NewLLRBMVCC(0)
+	for j := int64(0); j < 100; j++ {
+		if j%2 == 0 {
+			writer.Insert(&KeyInt{j, j})
+		} else {
+			tree.Insert(&KeyInt{j, j})
+		}
+	}
+	snapshot := writer.RSnapshot(10)
+	writer.Insert(&KeyInt{1000, 1000})
+	other := struct{ Snapshot }{snapshot}
+	if n := tree.Union(snapshot, nil).Len(); n != 100 {
+		t.Fatalf("expected %v, got %v", 100, n)
+	} else if n := tree.Union(other, nil).Len(); n != 100 {
+		t.Fatalf("expected %v, got %v", 100, n)
+	} else if n := writer.Intersection(other, nil).Len(); n != 50 {
+		t.Fatalf("expected %v, got %v", 50, n)
+	} else if n := writer.Difference(other).Len(); n != 1 {
+		t.Fatalf("expected %v, got %v", 1, n)
+	}
+	snapshot.Release()
+}
+
+func TestSplitJoin(t *testing.T) {
+	items := func(store Snapshot) []Item {
+		items := []Item{}
+		store.Range(nil, nil, "both", func(item Item) bool {
+			items = append(items, item)
+			return true
+		})
+		return items
+	}
+	for _, n := range []int{0, 1, 2, 3, 10, 100, 1000} {
+		for k := 0; k < 3; k++ {
+			dups, tombs := k == 1, k == 2
+			tree, writer := NewLLRB(), NewLLRBMVCC(0)
+			tree.SetDuplicates(dups)
+			writer.SetDuplicates(dups)
+			writer.SetTombstones(tombs)
+			for i := 0; i < n; i++ {
+				item := &KeyInt{rand.Int63n(int64(n) + 1), int64(i)}
+				tree.Insert(item)
+				writer.Insert(item)
+				if i%3 == 0 {
+					tree.Delete(item)
+					writer.Delete(item)
+				}
+			}
+			ref := items(tree)
+			key := &KeyInt{rand.Int63n(int64(n) + 2), 0}
+			snapshot := writer.RSnapshot(10)
+
+			l1, r1 := tree.Split(key)
+			l2, r2 := writer.Split(key)
+			for _, pair := range [][2]MemStore{{l1, r1}, {l2, r2}} {
+				left, right := pair[0], pair[1]
+				validateTree(t, rootOf(left))
+				validateTree(t, rootOf(right))
+				i := rankOf(buildTree(&tree.algo, ref, newNode), key, false)
+				if !reflect.DeepEqual(items(left), ref[:i]) {
+					t.Fatalf("unexpected left tree for %v", key)
+				} else if !reflect.DeepEqual(items(right), ref[i:]) {
+					t.Fatalf("unexpected right tree for %v", key)
+				} else if left.Len() != i || right.Len() != len(ref)-i {
+					t.Fatalf("expected %v %v, got %v %v", i, len(ref)-i, left.Len(), right.Len())
+				}
+			}
+			if tree.Len() != 0 || writer.Len() != 0 {
+				t.Fatalf("expected split trees to be empty")
+			} else if l2.Tombstones() != tombs || r2.Tombstones() != tombs {
+				t.Fatalf("expected tombstones %v", tombs)
+			}
+			if !reflect.DeepEqual(items(snapshot), ref) {
+				t.Fatalf("expected snapshot to be untouched")
+			}
+			validateTree(t, rootOf(snapshot))
+			snapshot.Release()
+
+			if max, min := l1.Max(), r1.Min(); max != nil && min != nil {
+				l1.Delete(max)
+				l2.Delete(max)
+				r1.Delete(min)
+				r2.Delete(min)
+				ref = append(items(l1), items(r1)...)
+			}
+			lsnap, rsnap := l2.RSnapshot(10), r2.RSnapshot(10)
+			for _, joined := range []MemStore{Join(l1, r1), JoinMVCC(l2, r2)} {
+				validateTree(t, rootOf(joined))
+				if !reflect.DeepEqual(items(joined), ref) {
+					t.Fatalf("unexpected joined tree")
+				} else if joined.Len() != len(ref) {
+					t.Fatalf("expected %v, got %v", len(ref), joined.Len())
+				}
+			}
+			if lsnap.Len()+rsnap.Len() != len(ref) {
+				t.Fatalf("expected snapshots to be untouched")
+			}
+			validateTree(t, rootOf(lsnap))
+			validateTree(t, rootOf(rsnap))
+			lsnap.Release()
+			rsnap.Release()
+		}
+	}
+
+	// trees of very different heights, and black heights tracked
+	// while splitting.
+	small, large := NewLLRB(), NewLLRB()
+	for i := int64(0); i < 5000; i++ {
+		if i < 3 {
+			small.Upsert(&KeyInt{i, i})
+		} else {
+			large.Upsert(&KeyInt{i, i})
+		}
+	}
+	joined := Join(small, large)
+	if validateTree(t, joined.root) != 5000 {
+		t.Fatalf("expected 5000")
+	}
+	for i := 0; i < 100; i++ {
+		tree := NewLLRB()
+		for j := 0; j < 1+rand.Intn(500); j++ {
+			tree.Upsert(&KeyInt{rand.Int63n(1000), 0})
+		}
+		l, lh, r, rh := splitTree(&tree.algo, tree.root, rand.Intn(tree.Len()+1), blackHeight(tree.root))
+		if lh != blackHeight(l) || rh != blackHeight(r) {
+			t.Fatalf("expected %v %v, got %v %v", blackHeight(l), blackHeight(r), lh, rh)
+		}
+	}
+
+	// overlapping trees cannot be joined.
+	left, right := NewLLRB(), NewLLRB()
+	left.Upsert(&KeyInt{10, 0})
+	right.Upsert(&KeyInt{10, 0})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		Join(left, right)
+	}()
+
+	// trees with different aggregates cannot be joined, trees
+	// configured with same functions can be.
+	left, right = NewLLRB(), NewLLRB()
+	left.SetAggregate(AggregateValue, CombineValues)
+	right.SetAggregate(AggregateValue, CombineValues)
+	left.Upsert(&KeyInt{10, 10})
+	right.Upsert(&KeyInt{20, 20})
+	ref := ValueAggregate{Count: 2, Sum: 30, Min: 10, Max: 20}
+	if agg := Join(left, right).Aggregate(nil, nil, "both"); agg != ref {
+		t.Fatalf("expected %v, got %v", ref, agg)
+	}
+	left, right = NewLLRB(), NewLLRB()
+	right.SetAggregate(AggregateValue, CombineValues)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		Join(left, right)
+	}()
+	lmvcc, rmvcc := NewLLRBMVCC(0), NewLLRBMVCC(0)
+	lmvcc.SetAggregate(AggregateValue, CombineValues)
+	rmvcc.SetAggregate(AggregateValue, func(x, y Aggregate) Aggregate { return x })
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		JoinMVCC(lmvcc, rmvcc)
+	}()
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	type change struct {
+		op       string
+		old, new Item
+	}
+	reference := func(older, newer Snapshot) []change {
+		changes := []change{}
+		olds := map[int64]Item{}
+		older.Range(nil, nil, "both", func(item Item) bool {
+			olds[item.(*KeyInt).Key] = item
+			return true
+		})
+		newer.Range(nil, nil, "both", func(item Item) bool {
+			old, ok := olds[item.(*KeyInt).Key]
+			if !ok {
+				changes = append(changes, change{"insert", nil, item})
+			} else if old != item {
+				changes = append(changes, change{"update", old, item})
+			}
+			delete(olds, item.(*KeyInt).Key)
+			return true
+		})
+		for _, old := range olds {
+			changes = append(changes, change{"delete", old, nil})
+		}
+		sort.SliceStable(changes, func(i, j int) bool {
+			key := func(c change) int64 {
+				if c.old != nil {
+					return c.old.(*KeyInt).Key
+				}
+				return c.new.(*KeyInt).Key
+			}
+			return key(changes[i]) < key(changes[j])
+		})
+		return changes
+	}
+
+	writer := NewLLRBMVCC(0)
+	for i := 0; i < 10000; i++ {
+		writer.Upsert(&KeyInt{rand.Int63n(20000), int64(i)})
+	}
+	for _, nops := range []int{0, 1, 10, 100, 10000} {
+		older := writer.RSnapshot(10)
+		for i := 0; i < nops; i++ {
+			key := &KeyInt{rand.Int63n(20000), int64(i)}
+			switch i % 4 {
+			case 0, 1:
+				writer.Upsert(key)
+			case 2:
+				writer.Delete(key)
+			case 3:
+				writer.DeleteRange(key, &KeyInt{key.Key + 10, 0}, "both")
+			}
+		}
+		newer := writer.RSnapshot(10)
+		ref, changes := reference(older, newer), []change{}
+		writer.Diff(older, newer, func(op string, old, new Item) bool {
+			changes = append(changes, change{op, old, new})
+			return true
+		})
+		if !reflect.DeepEqual(changes, ref) {
+			t.Fatalf("%v: expected %v changes, got %v", nops, len(ref), len(changes))
+		}
+		changes = changes[:0]
+		writer.Diff(older, writer, func(op string, old, new Item) bool {
+			changes = append(changes, change{op, old, new})
+			return len(changes) < 5
+		})
+		if len(ref) > 5 {
+			ref = ref[:5]
+		}
+		if !reflect.DeepEqual(changes, ref) {
+			t.Fatalf("%v: expected %v changes, got %v", nops, len(ref), len(changes))
+		}
+		older.Release()
+		newer.Release()
+	}
+
+	// released and expired snapshots cannot be diffed.
+	nop := func(op string, old, new Item) bool { return true }
+	older, newer := writer.RSnapshot(10), writer.RSnapshot(10)
+	older.Release()
+	if err := writer.Diff(older, newer, nop); err != ErrReleased {
+		t.Fatalf("expected %v, got %v", ErrReleased, err)
+	}
+	writer.SetExpiry(time.Nanosecond, nil)
+	time.Sleep(time.Millisecond)
+	if n := writer.ExpireSnapshots(); n != 1 {
+		t.Fatalf("expected %v, got %v", 1, n)
+	} else if err := writer.Diff(newer, writer, nop); err != ErrExpired {
+		t.Fatalf("expected %v, got %v", ErrExpired, err)
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	type intervals interface {
+		MemStore
+		SetIntervals(allow bool)
+		Overlaps(a, b Item, iter KeyIterator)
+		Stab(point Item, iter KeyIterator)
+	}
+	overlapping := func(items []Item, a, b int64) []Item {
+		result := []Item{}
+		for _, item := range items {
+			if kiv := item.(*KeyInterval); kiv.Start <= b && kiv.End >= a {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	bulk := []Item{}
+	for i := int64(0); i < 100; i++ {
+		bulk = append(bulk, &KeyInterval{i * 10, i*10 + rand.Int63n(50), 0})
+	}
+	for _, store := range []intervals{NewLLRB(), NewLLRBMVCC(0)} {
+		store.SetIntervals(true)
+		store.UpsertBulk(bulk...)
+		for i := 0; i < 5000; i++ {
+			start := rand.Int63n(1000)
+			kiv := &KeyInterval{start, start + rand.Int63n(100), int64(i)}
+			switch i % 5 {
+			case 0, 1, 2:
+				store.Upsert(kiv)
+			case 3:
+				store.Delete(kiv)
+			case 4:
+				store.DeleteMin()
+			}
+			if i%500 != 0 {
+				continue
+			}
+			validateTree(t, rootOf(store))
+			items := []Item{}
+			store.Range(nil, nil, "both", func(item Item) bool {
+				items = append(items, item)
+				return true
+			})
+			for j := 0; j < 50; j++ {
+				a := rand.Int63n(1200) - 100
+				b := a + rand.Int63n(50)
+				result := []Item{}
+				store.Overlaps(&KeyInt{a, 0}, &KeyInt{b, 0}, func(item Item) bool {
+					result = append(result, item)
+					return true
+				})
+				if ref := overlapping(items, a, b); !reflect.DeepEqual(result, ref) {
+					t.Fatalf("overlaps [%v, %v]: expected %v, got %v", a, b, ref, result)
+				}
+				result = result[:0]
+				store.Stab(&KeyInt{a, 0}, func(item Item) bool {
+					result = append(result, item)
+					return len(result) < 3
+				})
+				ref := overlapping(items, a, a)
+				if len(ref) > 3 {
+					ref = ref[:3]
+				}
+				if !reflect.DeepEqual(result, ref) {
+					t.Fatalf("stab %v: expected %v, got %v", a, ref, result)
+				}
+			}
+		}
+	}
+
+	// trees not configured with SetIntervals are not interval trees,
+	// even if their elements are intervals, trees created by Split
+	// keep intervals of their tree.
+	tree := NewLLRB()
+	for i := int64(0); i < 100; i++ {
+		tree.Upsert(&KeyInterval{i, i + 10, 0})
+	}
+	if tree.root.Meta.ext {
+		t.Fatalf("expected nodes without maxend")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		tree.Stab(&KeyInt{10, 0}, func(Item) bool { return true })
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		tree.SetIntervals(true)
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		other := NewLLRB()
+		other.SetIntervals(true)
+		other.Upsert(&KeyInterval{200, 210, 0})
+		Join(tree, other)
+	}()
+	tree = NewLLRB()
+	tree.SetIntervals(true)
+	for i := int64(0); i < 100; i++ {
+		tree.Insert(&KeyInterval{i, i + 10, 0})
+	}
+	_, right := tree.Split(&KeyInterval{50, 50, 0})
+	right.Insert(&KeyInterval{60, 200, 0})
+	validateTree(t, right.root)
+	result := []Item{}
+	right.Stab(&KeyInt{150, 0}, func(item Item) bool {
+		result = append(result, item)
+		return true
+	})
+	if len(result) != 1 {
+		t.Fatalf("expected 1 interval, got %v", result)
+	}
+
+	// snapshots are taken, and queried, concurrently with the
+	// writer populating the tree.
+	writer := NewLLRBMVCC(0)
+	writer.SetIntervals(true)
+	var wg sync.WaitGroup
+	started, done := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			if n == 1 {
+				close(started)
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			snapshot, err := writer.RSnapshotContext(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			snapshot.(intervals).Stab(&KeyInt{1, 0}, func(Item) bool { return true })
+			snapshot.Release()
+		}
+	}()
+	<-started
+	for i := int64(0); i < 1000; i++ {
+		writer.Upsert(&KeyInterval{i, i + 2, 0})
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestAggregate(t *testing.T) {
+	type aggregator interface {
+		MemStore
+		SetAggregate(func(Item) Aggregate, func(a, b Aggregate) Aggregate)
+		Aggregate(low, high Item, incl string) Aggregate
+	}
+	incls := []string{"none", "low", "high", "both"}
+	aggregate := func(store Snapshot, low, high Item, incl string) Aggregate {
+		var agg Aggregate
+		store.Range(low, high, incl, func(item Item) bool {
+			agg = values.merge(agg, AggregateValue(item))
+			return true
+		})
+		return agg
+	}
+	for _, dups := range []bool{false, true} {
+		llrb, mvcc := NewLLRB(), NewLLRBMVCC(0)
+		llrb.SetDuplicates(dups)
+		mvcc.SetDuplicates(dups)
+		for _, store := range []aggregator{llrb, mvcc} {
+			store.SetAggregate(AggregateValue, CombineValues)
+			for i := 0; i < 5000; i++ {
+				key := &KeyInt{rand.Int63n(1000), rand.Int63n(2000) - 1000}
+				switch i % 5 {
+				case 0, 1, 2:
+					store.Upsert(key)
+				case 3:
+					store.Delete(key)
+				case 4:
+					store.DeleteMin()
+				}
+				if i%500 != 0 {
+					continue
+				}
+				validateTree(t, rootOf(store))
+				var snapshot Snapshot = store
+				if mvcc, ok := store.(*LLRBMVCC); ok {
+					snapshot = mvcc.RSnapshot(10)
+					mvcc.Upsert(&KeyInt{rand.Int63n(1000), 1})
+				}
+				for j := 0; j < 50; j++ {
+					var low, high Item
+					if j%10 != 0 {
+						a := rand.Int63n(1200) - 100
+						low, high = &KeyInt{a, 0}, &KeyInt{a + rand.Int63n(200), 0}
+					}
+					incl := incls[j%len(incls)]
+					ref := aggregate(snapshot, low, high, incl)
+					if agg := snapshot.Aggregate(low, high, incl); !reflect.DeepEqual(agg, ref) {
+						t.Fatalf("aggregate %v %v %v: expected %v, got %v",
+							low, high, incl, ref, agg)
+					}
+				}
+				if snapshot != Snapshot(store) {
+					snapshot.Release()
+				}
+			}
+		}
+	}
+
+	// trees without an aggregate don't maintain one, trees created
+	// by Split and Join keep the aggregate of their tree.
+	tree := NewLLRB()
+	for i := int64(0); i < 100; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+	if tree.root.Meta.ext {
+		t.Fatalf("expected nodes without aggregate")
+	} else if size := unsafe.Sizeof(*tree.root); size > 8*unsafe.Sizeof(uintptr(0)) {
+		t.Fatalf("expected nodes of atmost 8 words, got %v bytes", size)
+	}
+	tree = NewLLRB()
+	tree.SetAggregate(AggregateValue, CombineValues)
+	for i := int64(0); i < 100; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+	left, right := tree.Split(&KeyInt{50, 0})
+	left.Upsert(&KeyInt{10, 1000})
+	right.Upsert(&KeyInt{60, 1000})
+	joined := Join(left, right)
+	joined.Upsert(&KeyInt{100, 100})
+	validateTree(t, joined.root)
+	ref := ValueAggregate{Count: 101, Sum: 6980, Min: 0, Max: 1000}
+	if agg := joined.Aggregate(nil, nil, "both"); agg != ref {
+		t.Fatalf("expected %v, got %v", ref, agg)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+		var snapshot Snapshot
+		for i := 0; i < 5000; i++ {
+			key := &KeyInt{rand.Int63n(1000), int64(i)}
+			switch i % 7 {
+			case 0, 1, 2:
+				store.Upsert(key)
+			case 3:
+				store.Delete(key)
+			case 4:
+				store.DeleteMin()
+			case 5:
+				store.DeleteRange(key, &KeyInt{key.Key + 10, 0}, "both")
+			case 6:
+				store.UpsertBulk(&KeyInt{key.Key, 0}, &KeyInt{key.Key + 1, 0})
+			}
+			if i == 2500 {
+				snapshot = store.RSnapshot(10)
+			}
+		}
+		size := 0
+		store.Range(nil, nil, "both", func(item Item) bool {
+			size += item.Size()
+			return true
+		})
+		if x := store.(interface{ Size() int }).Size(); x != size {
+			t.Fatalf("expected size %v, got %v", size, x)
+		}
+		stats := store.Stats()
+		if x := stats["node.count"].(int); x != store.Len() {
+			t.Fatalf("expected %v nodes, got %v", store.Len(), x)
+		} else if x := stats["item.bytes"].(int); x != size {
+			t.Fatalf("expected %v bytes, got %v", size, x)
+		} else if x := stats["node.overhead"].(int); x != store.Len()*nodeSize {
+			t.Fatalf("expected %v overhead, got %v", store.Len()*nodeSize, x)
+		}
+		avg, stddev := store.HeightStats()
+		if stats["height.avg"].(float64) != avg || stats["height.stddev"].(float64) != stddev {
+			t.Fatalf("expected height %v %v, got %v", avg, stddev, stats)
+		} else if x := stats["height.max"].(int); float64(x) < avg {
+			t.Fatalf("unexpected max height %v for average %v", x, avg)
+		}
+
+		if _, ok := store.(*LLRBMVCC); !ok {
+			continue
+		}
+		if x := stats["snapshot.count"].(int); x != 1 {
+			t.Fatalf("expected 1 snapshot, got %v", x)
+		} else if stats["snapshot.nodes"].(int) == 0 {
+			t.Fatalf("expected nodes held by snapshot")
+		} else if x := stats["snapshot.bytes"].(int); x <= stats["snapshot.nodes"].(int)*nodeSize {
+			t.Fatalf("expected items held by snapshot, got %v bytes", x)
+		}
+		snapshot.Release()
+		stats = store.Stats()
+		if x := stats["snapshot.bytes"].(int); x != 0 {
+			t.Fatalf("expected 0 bytes held by snapshots, got %v", x)
+		}
+	}
+
+	// stats don't close epochs, and can be read on a snapshot
+	// concurrently with the writer.
+	tree := NewLLRBMVCC(0)
+	snapshot := tree.RSnapshot(0)
+	if x := tree.Stats()["snapshot.count"].(int); x != 1 {
+		t.Fatalf("expected 1 snapshot, got %v", x)
+	} else if x := len(tree.snapshots); x != 0 {
+		t.Fatalf("expected no closed epochs, got %v", x)
+	}
+	stats := snapshot.(interface{ Stats() map[string]interface{} }).Stats
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if x := stats()["snapshot.count"].(int); x < 1 {
+				t.Errorf("expected atleast 1 snapshot, got %v", x)
+				return
+			}
+		}
+	}()
+	for i := int64(0); i < 1000; i++ {
+		tree.Upsert(&KeyInt{i % 100, i})
+	}
+	wg.Wait()
+	snapshot.Release()
+}
+
+func TestNodePool(t *testing.T) {
+	slabs := NewSlabPool(64)
+	llrb, mvcc := NewLLRB(), NewLLRBMVCC(0)
+	llrb.SetNodePool(NewNodePool(slabs))
+	mvcc.SetNodePool(NewNodePool(slabs))
+	for _, store := range []MemStore{llrb, mvcc} {
+		d := NewDict()
+		for i := 0; i < 20000; i++ {
+			key := &KeyInt{rand.Int63n(2000), int64(i)}
+			switch i % 6 {
+			case 0, 1:
+				store.Upsert(key)
+				d.Upsert(key)
+			case 2:
+				store.Delete(key)
+				d.Delete(key)
+			case 3:
+				store.DeleteMin()
+				d.DeleteMin()
+			case 4:
+				store.DeleteMax()
+				d.DeleteMax()
+			case 5:
+				high := &KeyInt{key.Key + 20, 0}
+				store.DeleteRange(key, high, "low")
+				d.DeleteRange(key, high, "low")
+			}
+			if i%1000 == 0 {
+				keys := []Item{&KeyInt{key.Key, 0}, &KeyInt{key.Key + 1, 0}}
+				store.UpsertBulk(keys...)
+				d.UpsertBulk(keys...)
+			}
+		}
+		validateTree(t, rootOf(store))
+		if store.Len() != d.Len() {
+			t.Fatalf("expected %v elements, got %v", d.Len(), store.Len())
+		}
+		d.Range(nil, nil, "both", func(item Item) bool {
+			if x := store.Get(item); x == nil || x.(*KeyInt).Value != item.(*KeyInt).Value {
+				t.Fatalf("expected %v, got %v", item, x)
+			}
+			return true
+		})
+	}
+
+	stats := llrb.pool.Stats()
+	allocs, frees := stats["node.alloc"].(int64), stats["node.free"].(int64)
+	if frees == 0 {
+		t.Fatalf("expected nodes to be freed")
+	} else if live := allocs - frees; live != int64(llrb.Len()) {
+		t.Fatalf("expected %v live nodes, got %v", llrb.Len(), live)
+	}
+	stats = mvcc.pool.Stats()
+	if stats["node.alloc"].(int64) == 0 || stats["node.slabs"].(int64) == 0 {
+		t.Fatalf("expected nodes allocated from slabs, got %v", stats)
+	}
+	if x := slabs.Stats()["slab.alloc"].(int64); x < stats["node.slabs"].(int64) {
+		t.Fatalf("expected at least %v slabs, got %v", stats["node.slabs"], x)
+	}
+
+	// emptied slabs shall be freed to the slab pool and reused.
+	for i := 0; i < 1000; i++ {
+		llrb.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	for llrb.Len() > 0 {
+		llrb.DeleteMin()
+	}
+	if x := llrb.pool.Stats()["node.slabfree"].(int64); x == 0 {
+		t.Fatalf("expected slabs freed by node pool")
+	}
+	stats = slabs.Stats()
+	nfree := stats["slab.freelist"].(int64)
+	if stats["slab.free"].(int64) == 0 || nfree == 0 {
+		t.Fatalf("expected free slabs, got %v", stats)
+	}
+	for i := 0; i < 1000; i++ {
+		llrb.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	validateTree(t, llrb.Root())
+	if x := slabs.Stats()["slab.freelist"].(int64); x >= nfree {
+		t.Fatalf("expected free slabs to be reused, %v before %v after", nfree, x)
+	}
+}
+
+func TestRecycleNodes(t *testing.T) {
+	type snapshot struct {
+		store *LLRBMVCC
+		items []Item
+	}
+	pools := []*NodePool{NewNodePool(nil), NewNodePool(NewSlabPool(32))}
+	for _, pool := range pools {
+		tree := NewLLRBMVCC(0)
+		tree.SetNodePool(pool)
+		snapshots := []snapshot{}
+		for i := 0; i < 20000; i++ {
+			key := &KeyInt{rand.Int63n(1000), int64(i)}
+			switch rand.Intn(8) {
+			case 0, 1, 2:
+				tree.Upsert(key)
+			case 3:
+				tree.Delete(key)
+			case 4:
+				tree.DeleteMin()
+			case 5:
+				tree.DeleteRange(key, &KeyInt{key.Key + 10, 0}, "both")
+			case 6:
+				tree.UpsertFunc(key, func(old Item) (Item, bool) {
+					return key, old != nil
+				})
+			case 7:
+				if len(snapshots) < 9 {
+					s := tree.RSnapshot(10).(*LLRBMVCC)
+					snapshots = append(snapshots, snapshot{s, itemsOf(s)})
+				} else { // release in any order.
+					j := rand.Intn(len(snapshots))
+					snapshots[j].store.Release()
+					snapshots = append(snapshots[:j], snapshots[j+1:]...)
+				}
+			}
+			if i%500 != 0 {
+				continue
+			}
+			validateTree(t, tree.Root())
+			stores := []*LLRBMVCC{tree}
+			for _, s := range snapshots {
+				checkItems(t, s.store, s.items)
+				stores = append(stores, s.store)
+			}
+			checkRecycled(t, pool, stores...)
+		}
+		for _, s := range snapshots {
+			s.store.Release()
+		}
+		tree.Upsert(&KeyInt{0, 0})
+		stats := tree.Stats()
+		if x := stats["snapshot.nodes"].(int); x != 0 {
+			t.Fatalf("expected no nodes held by snapshots, got %v", x)
+		} else if stats["node.recycled"].(int64) == 0 {
+			t.Fatalf("expected recycled nodes, got %v", stats)
+		}
+	}
+}
+
+func TestRecycleSplitJoin(t *testing.T) {
+	mutate := func(tree *LLRBMVCC, base int64) {
+		for i := 0; i < 2000; i++ {
+			key := &KeyInt{base + rand.Int63n(1000), int64(i)}
+			if i%2 == 0 {
+				tree.Upsert(key)
+			} else {
+				tree.Delete(key)
+			}
+		}
+	}
+	tree := NewLLRBMVCC(0)
+	for i := int64(0); i < 2000; i++ {
+		tree.Upsert(&KeyInt{i, 0})
+	}
+	snapshot := tree.RSnapshot(10).(*LLRBMVCC)
+	items := itemsOf(snapshot)
+
+	// nodes shared with snapshot, and all nodes reclaimed after
+	// them, shall wait for snapshot to be released.
+	left, right := tree.Split(&KeyInt{1000, 0})
+	mutate(left, 0)
+	mutate(right, 1000)
+	checkRecycled(t, left.pool, snapshot)
+	checkRecycled(t, right.pool, snapshot)
+	joined := JoinMVCC(left, right)
+	mutate(joined, 500)
+	checkRecycled(t, joined.pool, snapshot)
+	checkItems(t, snapshot, items)
+	for _, tree := range []*LLRBMVCC{left, right, joined} {
+		if x := tree.pool.Stats()["node.recycled"].(int64); x != 0 {
+			t.Fatalf("expected nodes to wait for snapshot, got %v recycled", x)
+		}
+	}
+
+	snapshot.Release()
+	mutate(joined, 0)
+	validateTree(t, joined.Root())
+	if x := joined.pool.Stats()["node.recycled"].(int64); x == 0 {
+		t.Fatalf("expected recycled nodes after releasing snapshot")
+	}
+}
+
+func TestRecycleConcurrent(t *testing.T) {
+	type job struct {
+		snapshot Snapshot
+		agg      ValueAggregate
+	}
+	tree := NewLLRBMVCC(0)
+	tree.SetAggregate(AggregateValue, CombineValues)
+	tree.SetNodePool(NewNodePool(NewSlabPool(64)))
+	for i := int64(0); i < 1000; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+
+	var wg sync.WaitGroup
+	jobs, errs := make(chan job, 3), make(chan error, 1)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				count, sum := int64(0), int64(0)
+				j.snapshot.Range(nil, nil, "both", func(item Item) bool {
+					count, sum = count+1, sum+item.(*KeyInt).Value
+					return true
+				})
+				if count != j.agg.Count || sum != j.agg.Sum {
+					err := fmt.Errorf("expected %v items summing to %v, got %v, %v",
+						j.agg.Count, j.agg.Sum, count, sum)
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+				j.snapshot.Release()
+			}
+		}()
+	}
+	for i := 0; i < 20000; i++ {
+		key := &KeyInt{rand.Int63n(1000), rand.Int63n(1000)}
+		switch i % 3 {
+		case 0, 1:
+			tree.Upsert(key)
+		case 2:
+			tree.Delete(key)
+		}
+		if i%50 == 0 {
+			snapshot := tree.RSnapshot(1000)
+			agg := snapshot.Aggregate(nil, nil, "both").(ValueAggregate)
+			jobs <- job{snapshot, agg}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	if x := tree.Stats()["node.recycled"].(int64); x == 0 {
+		t.Fatalf("expected recycled nodes")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, tombs := range []bool{false, true} {
+		pool := NewNodePool(nil)
+		ref, tree := NewLLRB(), NewLLRBMVCC(0)
+		tree.SetNodePool(pool)
+		tree.SetTombstones(tombs)
+		for i := 0; i < 1000; i++ {
+			item := &KeyInt{int64(i), int64(i)}
+			ref.Upsert(item)
+			tree.Upsert(item)
+		}
+
+		snapshot := tree.RSnapshot(0)
+		items := itemsOf(snapshot)
+		batch := tree.Batch()
+		for i := 0; i < 500; i++ {
+			key := &KeyInt{int64(rand.Intn(1200)), int64(i)}
+			switch i % 6 {
+			case 0:
+				ref.Delete(key)
+				batch.Delete(key)
+			case 1:
+				ref.Insert(key)
+				batch.Insert(key)
+			case 2:
+				ref.DeleteMin()
+				batch.DeleteMin()
+			case 3:
+				ref.DeleteMax()
+				batch.DeleteMax()
+			default:
+				ref.Upsert(key)
+				batch.Upsert(key)
+			}
+		}
+		root := tree.Root()
+		if batch.Len() != 500 {
+			t.Fatalf("expected %v writes, got %v", 500, batch.Len())
+		}
+		batch.Commit()
+		if batch.Len() != 0 {
+			t.Fatalf("expected empty batch")
+		} else if tree.Root() == root {
+			t.Fatalf("expected new root")
+		} else if tree.Len() != ref.Len() {
+			t.Fatalf("expected %v, got %v", ref.Len(), tree.Len())
+		}
+		validateTree(t, tree.Root())
+		checkItems(t, tree, itemsOf(ref))
+		checkItems(t, snapshot, items)
+		checkRecycled(t, pool, tree, snapshot.(*LLRBMVCC))
+		snapshot.Release()
+		tree.Upsert(&KeyInt{0, 0})
+		checkRecycled(t, pool, tree)
+
+		// nodes removed within the batch are freed as well.
+		batch.Upsert(&KeyInt{2000, 0})
+		batch.Upsert(&KeyInt{2001, 0})
+		batch.Delete(&KeyInt{2000, 0})
+		batch.DeleteMax()
+		batch.Commit()
+		nodes := int64(0)
+		walkTree(tree.Root(), 0, func(*Node, int) { nodes++ })
+		stats := pool.Stats()
+		if n := stats["node.alloc"].(int64) - stats["node.free"].(int64); n != nodes {
+			t.Fatalf("expected %v nodes in use, got %v", nodes, n)
+		}
+		checkRecycled(t, pool, tree)
+	}
+
+	// nodes copied within a batch are not copied again.
+	writes := func(fn func(tree *LLRBMVCC)) int64 {
+		pool := NewNodePool(nil)
+		tree := NewLLRBMVCC(0)
+		tree.SetNodePool(pool)
+		for i := 0; i < 1000; i++ {
+			tree.Upsert(&KeyInt{int64(i), int64(i)})
+		}
+		allocs := pool.Stats()["node.alloc"].(int64)
+		fn(tree)
+		return pool.Stats()["node.alloc"].(int64) - allocs
+	}
+	single := writes(func(tree *LLRBMVCC) {
+		for i := 0; i < 100; i++ {
+			tree.Upsert(&KeyInt{int64(i), -1})
+		}
+	})
+	batched := writes(func(tree *LLRBMVCC) {
+		batch := tree.Batch()
+		for i := 0; i < 100; i++ {
+			batch.Upsert(&KeyInt{int64(i), -1})
+		}
+		batch.Commit()
+	})
+	if batched*2 > single {
+		t.Fatalf("expected batch to copy fewer nodes, %v vs %v", batched, single)
+	}
+
+	// a write that panics discards the batch, writer is usable.
+	pool := NewNodePool(nil)
+	tree := NewLLRBMVCC(0)
+	tree.SetNodePool(pool)
+	for i := 0; i < 100; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	root, items := tree.Root(), itemsOf(tree)
+	batch := tree.Batch()
+	batch.Upsert(&KeyInt{1000, 0})
+	batch.Delete(&KeyInt{10, 0})
+	batch.Upsert(&KeyString{"panic", 0})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		batch.Commit()
+	}()
+	if tree.Root() != root || tree.Len() != len(items) {
+		t.Fatalf("expected tree to be untouched")
+	}
+	key := &KeyInt{1000, 0}
+	tree.Upsert(key)
+	validateTree(t, tree.Root())
+	checkItems(t, tree, append(items, key))
+	checkRecycled(t, pool, tree)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic deleting nil key")
+			}
+		}()
+		tree.Batch().Delete(nil)
+	}()
+
+	// readers see either none or all of the writes in a batch.
+	tree = NewLLRBMVCC(0)
+	tree.Upsert(&KeyInt{1, 100})
+	tree.Upsert(&KeyInt{2, 0})
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := tree.RSnapshot(0)
+				x := snapshot.Get(&KeyInt{1, 0}).(*KeyInt).Value
+				y := snapshot.Get(&KeyInt{2, 0}).(*KeyInt).Value
+				if x+y != 100 {
+					t.Errorf("expected %v, got %v", 100, x+y)
+				}
+				// batches upto seqno are seen by snapshot.
+				seqno := uint64(2)
+				if item := snapshot.Get(&KeyInt{3, 0}); item != nil {
+					seqno += 99 * uint64(item.(*KeyInt).Value+1)
+				}
+				if n := snapshot.(*LLRBMVCC).Seqno(); n > seqno || (n-2)%99 != 0 {
+					t.Errorf("expected upto %v, got %v", seqno, n)
+				}
+				snapshot.Release()
+			}
+		}()
+	}
+	batch = tree.Batch()
+	for i := int64(0); i < 1000; i++ {
+		batch.Upsert(&KeyInt{1, 100 - i%100})
+		for j := int64(3); j < 100; j++ {
+			batch.Upsert(&KeyInt{j, i})
+		}
+		batch.Upsert(&KeyInt{2, i % 100})
+		batch.Commit()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRSnapshotContext(t *testing.T) {
+	tree := NewLLRBMVCC(0)
+	tree.Upsert(&KeyInt{1, 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.RSnapshotContext(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if _, err := tree.RSnapshotContext(ctx); err != ErrTimeout {
+		t.Fatalf("expected %v, got %v", ErrTimeout, err)
+	}
+
+	// number of readers is not limited.
+	snapshots := make([]Snapshot, 0)
+	for i := 0; i < 1000; i++ {
+		snapshot, err := tree.RSnapshotContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if x := snapshot.Get(&KeyInt{1, 0}); x == nil {
+			t.Fatalf("expected %v", &KeyInt{1, 1})
+		}
+		snapshots = append(snapshots, snapshot)
+		tree.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	if x := tree.Stats()["snapshot.count"].(int); x != 1000 {
+		t.Fatalf("expected %v snapshots, got %v", 1000, x)
+	}
+	for _, snapshot := range snapshots {
+		snapshot.Release()
+	}
+	if x := tree.Stats()["snapshot.count"].(int); x != 0 {
+		t.Fatalf("expected no snapshots, got %v", x)
+	}
+}
+
+func TestSnapshotEpochs(t *testing.T) {
+	pool := NewNodePool(nil)
+	tree := NewLLRBMVCC(0)
+	tree.SetNodePool(pool)
+	for i := 0; i < 100; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	held := func() int { return tree.Stats()["snapshot.nodes"].(int) }
+
+	// snapshots acquired between writes share an epoch.
+	s1, s2 := tree.RSnapshot(0), tree.RSnapshot(0)
+	tree.Upsert(&KeyInt{10, 11})
+	s3 := tree.RSnapshot(0)
+	tree.Upsert(&KeyInt{20, 21})
+	if x := len(tree.snapshots); x != 2 {
+		t.Fatalf("expected 2 epochs, got %v", x)
+	}
+	n := held()
+	if n == 0 {
+		t.Fatalf("expected nodes held by snapshots")
+	}
+
+	// nodes of a newer epoch wait for older epochs.
+	s3.Release()
+	if x := held(); x != n {
+		t.Fatalf("expected %v nodes held, got %v", n, x)
+	}
+	s1.Release()
+	if x := held(); x != n {
+		t.Fatalf("expected %v nodes held, got %v", n, x)
+	}
+	s2.Release()
+	frees := pool.Stats()["node.free"].(int64)
+	tree.Upsert(&KeyInt{40, 41})
+	if x := held(); x != 0 {
+		t.Fatalf("expected no nodes held, got %v", x)
+	} else if x := pool.Stats()["node.free"].(int64); x < frees+int64(n) {
+		t.Fatalf("expected held nodes to be recycled")
+	}
+	checkRecycled(t, pool, tree)
+
+	// writes without readers don't start new epochs.
+	for i := 0; i < 100; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i + 1)})
+	}
+	if x := len(tree.snapshots); x != 0 {
+		t.Fatalf("expected no epochs, got %v", x)
+	}
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	for _, store := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+		store.Upsert(&KeyInt{1, 1})
+		snapshot := store.RSnapshot(10)
+		if err := snapshot.Release(); err != nil {
+			t.Fatal(err)
+		} else if err := snapshot.Release(); err != ErrReleased {
+			t.Fatalf("expected %v, got %v", ErrReleased, err)
+		} else if err := store.Release(); err != ErrNotSnapshot {
+			t.Fatalf("expected %v, got %v", ErrNotSnapshot, err)
+		}
+	}
+
+	// double release shall not leave the epoch twice.
+	tree := NewLLRBMVCC(0)
+	snapshot := tree.RSnapshot(10)
+	other := tree.RSnapshot(10)
+	snapshot.Release()
+	snapshot.Release()
+	if x := tree.Stats()["snapshot.count"].(int); x != 1 {
+		t.Fatalf("expected 1 snapshot, got %v", x)
+	}
+	other.Release()
+	snapshot = tree.RSnapshot(10)
+
+	// snapshots are read-only.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic writing into snapshot")
+			}
+		}()
+		snapshot.(*LLRBMVCC).Upsert(&KeyInt{2, 2})
+	}()
+	if snapshot.Len() != 0 || tree.Len() != 0 {
+		t.Fatalf("expected empty tree")
+	}
+	snapshot.Release()
+}
+
+func TestSnapshotLeaks(t *testing.T) {
+	pool := NewNodePool(nil)
+	tree := NewLLRBMVCC(0)
+	tree.SetNodePool(pool)
+	tree.SetSnapshotStacks(true)
+	for i := 0; i < 1000; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i)})
+	}
+	leaked := tree.RSnapshot(10)
+	items := itemsOf(leaked)
+	for i := 0; i < 100; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i + 1)})
+	}
+
+	infos := tree.Snapshots(0)
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 snapshot, got %v", len(infos))
+	} else if infos[0].Pinned == 0 {
+		t.Fatalf("expected pinned nodes")
+	} else if infos[0].Readers != 1 {
+		t.Fatalf("expected 1 reader, got %v", infos[0].Readers)
+	} else if infos[0].Seqno > leaked.(*LLRBMVCC).Seqno() {
+		t.Fatalf("expected upto %v, got %v", leaked.(*LLRBMVCC).Seqno(), infos[0].Seqno)
+	} else if !bytes.Contains(infos[0].Stack, []byte("TestSnapshotLeaks")) {
+		t.Fatalf("unexpected stack %s", infos[0].Stack)
+	} else if infos := tree.Snapshots(time.Hour); len(infos) != 0 {
+		t.Fatalf("expected no snapshots, got %v", len(infos))
+	}
+
+	// expire only the leaked snapshot.
+	snapshot := tree.RSnapshot(10)
+	tree.SetExpiry(time.Millisecond, func(info SnapshotInfo) bool {
+		return info.Seqno <= leaked.(*LLRBMVCC).Seqno()
+	})
+	time.Sleep(2 * time.Millisecond)
+	if n := tree.ExpireSnapshots(); n != 1 {
+		t.Fatalf("expected 1 expired, got %v", n)
+	} else if err := leaked.Release(); err != ErrExpired {
+		t.Fatalf("expected %v, got %v", ErrExpired, err)
+	}
+	if err := snapshot.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes reachable by expired snapshot are not reused.
+	for i := 0; i < 1000; i++ {
+		tree.Upsert(&KeyInt{int64(i), int64(i + 2)})
+		tree.Upsert(&KeyInt{int64(i), int64(i + 3)})
+	}
+	stats := pool.Stats()
+	if stats["node.recycled"].(int64) == 0 {
+		t.Fatalf("expected recycled nodes")
+	} else if stats["node.dropped"].(int64) == 0 {
+		t.Fatalf("expected dropped nodes")
+	}
+	checkRecycled(t, pool, leaked.(*LLRBMVCC))
+	checkItems(t, leaked, items)
+
+	// writer expires old snapshots while reclaiming nodes.
+	tree.SetExpiry(time.Millisecond, nil)
+	snapshot = tree.RSnapshot(10)
+	time.Sleep(2 * time.Millisecond)
+	tree.Upsert(&KeyInt{1, 1})
+	if err := snapshot.Release(); err != ErrExpired {
+		t.Fatalf("expected %v, got %v", ErrExpired, err)
+	} else if n := tree.Stats()["snapshot.expired"].(int64); n != 2 {
+		t.Fatalf("expected 2 expired, got %v", n)
+	}
+
+	// snapshots of an epoch are attributed to their own goroutines.
+	tree.SetExpiry(0, nil)
+	first := tree.RSnapshot(10)
+	leaked = leakSnapshot(tree)
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	tree.Upsert(&KeyInt{1, 2})
+	infos = tree.Snapshots(0)
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 snapshot, got %v", len(infos))
+	} else if !bytes.Contains(infos[0].Stack, []byte("leakSnapshot")) {
+		t.Fatalf("unexpected stack %s", infos[0].Stack)
+	}
+	leaked.Release()
+	if infos := tree.Snapshots(0); len(infos) != 0 {
+		t.Fatalf("expected no snapshots, got %v", len(infos))
+	}
+}
+
+func leakSnapshot(tree *LLRBMVCC) Snapshot {
+	return tree.RSnapshot(10)
+}
+
+func TestRSnapshotConcurrent(t *testing.T) {
+	tree := NewLLRBMVCC(0)
+	tree.SetNodePool(NewNodePool(NewSlabPool(64)))
+	for i := int64(0); i < 1000; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+
+	// readers take snapshots while the writer is writing.
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot, err := tree.RSnapshotContext(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				count := 0
+				snapshot.Range(nil, nil, "both", func(item Item) bool {
+					count++
+					return true
+				})
+				if count != snapshot.Len() {
+					t.Errorf("expected %v items, got %v", snapshot.Len(), count)
+				}
+				snapshot.Release()
+			}
+		}()
+	}
+	for i := 0; i < 20000; i++ {
+		key := &KeyInt{rand.Int63n(1000), int64(i)}
+		if i%3 == 2 {
+			tree.Delete(key)
+		} else {
+			tree.Upsert(key)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if x := tree.Stats()["node.recycled"].(int64); x == 0 {
+		t.Fatalf("expected recycled nodes")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ref, tree := NewLLRB(), NewLLRBMVCC(0)
+	ref.SetAggregate(AggregateValue, CombineValues)
+	tree.SetAggregate(AggregateValue, CombineValues)
+	tree.SetTombstones(true)
+	for i := 0; i < 1000; i++ {
+		key := &KeyInt{int64(i), int64(i)}
+		ref.Upsert(key)
+		tree.Upsert(key)
+	}
+	snapshot := tree.RSnapshot(10).(*LLRBMVCC)
+	older := itemsOf(snapshot)
+
+	rnd, seqno := rand.New(rand.NewSource(1)), tree.Seqno()
+	for i := 0; i < 5000; i++ {
+		key := &KeyInt{rnd.Int63n(1200), int64(i)}
+		var x, y Item
+		switch rnd.Intn(8) {
+		case 0, 1:
+			ref.Upsert(key)
+			tree.Upsert(key)
+			x, y = key, key
+		case 2, 3:
+			x, y = ref.Delete(key), tree.Delete(key)
+		case 4:
+			x, y = ref.DeleteMin(), tree.DeleteMin()
+		case 5:
+			x, y = ref.DeleteMax(), tree.DeleteMax()
+		case 6:
+			high := &KeyInt{key.Key + 5, 0}
+			if m, n := ref.DeleteRange(key, high, "low"), tree.DeleteRange(key, high, "low"); m != n {
+				t.Fatalf("expected %v, got %v", m, n)
+			} else if n > 0 {
+				x, y = key, key
+			}
+		case 7:
+			var next Item // same item upserted into both trees
+			incr := func(old Item) (Item, bool) {
+				if next != nil {
+					return next, true
+				} else if next = key; old != nil {
+					next = &KeyInt{key.Key, old.(*KeyInt).Value + 1}
+				}
+				return next, true
+			}
+			x, y = ref.UpsertFunc(key, incr), tree.UpsertFunc(key, incr)
+			if tree.Seqno() <= seqno {
+				t.Fatalf("expected seqno after %v, got %v", seqno, tree.Seqno())
+			}
+		}
+		if x != y {
+			t.Fatalf("expected %v, got %v", x, y)
+		} else if y != nil && tree.Seqno() <= seqno {
+			t.Fatalf("expected seqno after %v, got %v", seqno, tree.Seqno())
+		} else if tree.Seqno() < seqno {
+			t.Fatalf("expected seqno from %v, got %v", seqno, tree.Seqno())
+		}
+		seqno = tree.Seqno()
+	}
+	if n := validateTree(t, tree.Root()); n != ref.Len() || tree.Len() != ref.Len() {
+		t.Fatalf("expected %v elements, got %v %v", ref.Len(), n, tree.Len())
+	}
+	checkItems(t, tree, itemsOf(ref))
+	checkItems(t, snapshot, older)
+
+	// lookups skip tombstones.
+	for i := int64(-1); i < 1201; i++ {
+		key := &KeyInt{i, 0}
+		if x, y := ref.Get(key), tree.Get(key); x != y {
+			t.Fatalf("get %v: expected %v, got %v", i, x, y)
+		} else if x, y := ref.Floor(key), tree.Floor(key); x != y {
+			t.Fatalf("floor %v: expected %v, got %v", i, x, y)
+		} else if x, y := ref.Ceiling(key), tree.Ceiling(key); x != y {
+			t.Fatalf("ceiling %v: expected %v, got %v", i, x, y)
+		} else if x, y := ref.Lower(key), tree.Lower(key); x != y {
+			t.Fatalf("lower %v: expected %v, got %v", i, x, y)
+		} else if x, y := ref.Higher(key), tree.Higher(key); x != y {
+			t.Fatalf("higher %v: expected %v, got %v", i, x, y)
+		} else if x, y := ref.Rank(key), tree.Rank(key); x != y {
+			t.Fatalf("rank %v: expected %v, got %v", i, x, y)
+		}
+		high := &KeyInt{i + 100, 0}
+		x, y := ref.Aggregate(key, high, "both"), tree.Aggregate(key, high, "both")
+		if !reflect.DeepEqual(x, y) {
+			t.Fatalf("aggregate %v: expected %v, got %v", i, x, y)
+		}
+	}
+	if ref.Min() != tree.Min() || ref.Max() != tree.Max() {
+		t.Fatalf("expected %v %v, got %v %v", ref.Min(), ref.Max(), tree.Min(), tree.Max())
+	}
+	for i := 0; i < ref.Len(); i++ {
+		if x, y := ref.Select(i), tree.Select(i); x != y {
+			t.Fatalf("select %v: expected %v, got %v", i, x, y)
+		}
+	}
+	items, cur := []Item{}, tree.Cursor()
+	for cur.Last(); cur.Valid(); cur.Prev() {
+		items = append([]Item{cur.Item()}, items...)
+	}
+	checkItems(t, ref, items)
+
+	// diff sees deletes as tombstones.
+	deletes, inserts := make(map[Item]bool), make(map[Item]bool)
+	tree.Diff(snapshot, tree, func(op string, old, new Item) bool {
+		switch op {
+		case "delete":
+			deletes[old] = true
+		case "insert":
+			inserts[new] = true
+		case "update":
+			deletes[old], inserts[new] = true, true
+		}
+		return true
+	})
+	for _, item := range older {
+		if ref.Get(item) != item && !deletes[item] {
+			t.Fatalf("expected delete of %v", item)
+		}
+	}
+	for _, item := range itemsOf(ref) {
+		if snapshot.Get(item) != item && !inserts[item] {
+			t.Fatalf("expected insert of %v", item)
+		}
+	}
+
+	// purge removes tombstones older than every live snapshot.
+	ndead := tree.Stats()["node.tombstones"].(int)
+	if ndead == 0 {
+		t.Fatalf("expected tombstones")
+	} else if n := tree.Purge(tree.Seqno()); n != 0 {
+		t.Fatalf("expected no tombstones to purge, got %v", n)
+	}
+	snapshot.Release()
+	if n := tree.Purge(seqno / 2); n == 0 || n == ndead {
+		t.Fatalf("expected some of %v tombstones to purge, got %v", ndead, n)
+	} else if m := tree.Purge(tree.Seqno()); n+m != ndead {
+		t.Fatalf("expected %v tombstones to purge, got %v", ndead-n, m)
+	}
+	if x := tree.Stats()["node.tombstones"].(int); x != 0 {
+		t.Fatalf("expected no tombstones, got %v", x)
+	}
+	validateTree(t, tree.Root())
+	checkItems(t, tree, itemsOf(ref))
+
+	// purge copies every node atmost once, in a single version.
+	tree = NewLLRBMVCC(0)
+	tree.SetTombstones(true)
+	for i := int64(0); i < 1000; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+	for i := int64(0); i < 1000; i += 2 {
+		tree.Delete(&KeyInt{i, 0})
+	}
+	alloc := tree.pool.Stats()["node.alloc"].(int64)
+	if n := tree.Purge(tree.Seqno()); n != 500 {
+		t.Fatalf("expected %v tombstones to purge, got %v", 500, n)
+	} else if x := tree.pool.Stats()["node.alloc"].(int64) - alloc; x > 1000 {
+		t.Fatalf("expected atmost %v nodes copied, got %v", 1000, x)
+	}
+	validateTree(t, tree.Root())
+
+	// tombstones enabled on a populated tree extend nodes as they
+	// are copied.
+	tree = NewLLRBMVCC(0)
+	for i := int64(0); i < 1000; i++ {
+		tree.Upsert(&KeyInt{i, i})
+	}
+	if tree.Root().Meta.ext {
+		t.Fatalf("expected nodes not extended")
+	}
+	tree.SetTombstones(true)
+	for i := int64(0); i < 1000; i += 2 {
+		tree.Delete(&KeyInt{i, 0})
+	}
+	if !tree.Root().Meta.ext {
+		t.Fatalf("expected nodes extended")
+	} else if n := tree.Purge(tree.Seqno()); n != 500 {
+		t.Fatalf("expected %v tombstones to purge, got %v", 500, n)
+	}
+	validateTree(t, tree.Root())
+}
+
+func itemsOf(store Snapshot) []Item {
+	items := []Item{}
+	store.Range(nil, nil, "both", func(item Item) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+// checkItems fails unless store holds the same items, by identity.
+func checkItems(t *testing.T, store Snapshot, items []Item) {
+	got := itemsOf(store)
+	if len(got) != len(items) {
+		t.Fatalf("expected %v items, got %v", len(items), len(got))
+	}
+	for i, item := range items {
+		if got[i] != item {
+			t.Fatalf("expected %v at %v, got %v", item, i, got[i])
+		}
+	}
+}
+
+// checkRecycled fails if a node waiting to be reused by pool is
+// reachable from any of the trees.
+func checkRecycled(t *testing.T, pool *NodePool, trees ...*LLRBMVCC) {
+	free := make(map[*Node]bool)
+	for h := pool.freelist; h != nil; h = h.Left {
+		free[h] = true
+	}
+	for _, s := range pool.held {
+		for h := s.freelist; h != nil; h = h.Left {
+			free[h] = true
+		}
+	}
+	for _, tree := range trees {
+		walkTree(tree.Root(), 0, func(h *Node, _ int) {
+			if free[h] {
+				t.Fatalf("recycled node %p is reachable", h)
+			}
+		})
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	d := NewDict()
+	stores := []MemStore{NewLLRB(), NewLLRBMVCC(0)}
+	for _, i := range rand.Perm(100) {
+		d.Upsert(&KeyInt{int64(i * 3), int64(i)})
+		for _, store := range stores {
+			store.Upsert(&KeyInt{int64(i * 3), int64(i)})
+		}
+	}
+	// snapshot shall be unaffected by writes.
+	writer := stores[1]
+	snapshots := []Snapshot{stores[0], writer.RSnapshot(100)}
+	for i := 0; i < 100; i++ {
+		writer.Delete(&KeyInt{int64(i * 3), -1})
+	}
+	for k := int64(-2); k < 302; k++ {
+		key := &KeyInt{k, -1}
+		for _, store := range snapshots {
+			if ref, item := d.Floor(key), store.Floor(key); !reflect.DeepEqual(ref, item) {
+				t.Fatalf("floor %v expected %v, got %v", k, ref, item)
+			}
+			if ref, item := d.Ceiling(key), store.Ceiling(key); !reflect.DeepEqual(ref, item) {
+				t.Fatalf("ceiling %v expected %v, got %v", k, ref, item)
+			}
+			if ref, item := d.Lower(key), store.Lower(key); !reflect.DeepEqual(ref, item) {
+				t.Fatalf("lower %v expected %v, got %v", k, ref, item)
+			}
+			if ref, item := d.Higher(key), store.Higher(key); !reflect.DeepEqual(ref, item) {
+				t.Fatalf("higher %v expected %v, got %v", k, ref, item)
+			}
+		}
+	}
+	if item := writer.Floor(&KeyInt{300, -1}); item != nil {
+		t.Fatalf("unexpected %v", item)
+	}
+	snapshots[1].Release()
+}
+
+func TestDumpLoad(t *testing.T) {
+	trees := []MemStore{NewLLRB(), NewLLRBMVCC(0)}
+	for _, store := range trees {
+		tree := store.(interface {
+			Dump(w io.Writer) error
+			Load(r io.Reader) error
+		})
+		buf := bytes.NewBuffer(nil)
+		if err := tree.Dump(buf); err != nil {
+			t.Fatal(err)
+		}
+		empty := buf.Bytes()
+		for _, i := range rand.Perm(1000) {
+			store.Upsert(&KeyString{fmt.Sprintf("key%4d", i), int64(i)})
+		}
+		buf = bytes.NewBuffer(nil)
+		if err := tree.Dump(buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		for _, dst := range []MemStore{NewLLRB(), NewLLRBMVCC(0)} {
+			if err := dst.(interface{ Load(io.Reader) error }).Load(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if dst.Len() != 1000 {
+				t.Fatalf("expected 1000, got %v", dst.Len())
+			}
+			validateTree(t, rootOf(dst))
+			i := 0
+			dst.Range(nil, nil, "both", func(item Item) bool {
+				if kstr := item.(*KeyString); kstr.Value != int64(i) {
+					t.Fatalf("expected %v, got %v", i, kstr)
+				}
+				i++
+				return true
+			})
+			if err := dst.(interface{ Load(io.Reader) error }).Load(bytes.NewReader(empty)); err != nil {
+				t.Fatal(err)
+			} else if dst.Len() != 1000 {
+				t.Fatalf("expected 1000, got %v", dst.Len())
+			}
+		}
+
+		// corruption and truncation are detected.
+		corrupt := append([]byte{}, data...)
+		corrupt[len(corrupt)/2] ^= 0xff
+		if err := NewLLRB().Load(bytes.NewReader(corrupt)); err != ErrCorruptDump {
+			t.Fatalf("expected %v, got %v", ErrCorruptDump, err)
+		}
+		truncated := data[:len(data)-5]
+		if err := NewLLRB().Load(bytes.NewReader(truncated)); err != ErrCorruptDump {
+			t.Fatalf("expected %v, got %v", ErrCorruptDump, err)
+		}
+	}
+
+	// items of mixed types, and a wrong count, fail the dump.
+	root := &Node{Item: &KeyInt{2, 0}, Left: &Node{Item: &KeyString{"1", 0}}}
+	if err := dumpTree(io.Discard, root, 2, false, 0); err == nil {
+		t.Fatalf("expected error")
+	} else if err := dumpTree(io.Discard, root.Left, 1, false, 0); err != nil {
+		t.Fatal(err)
+	} else if err := dumpTree(io.Discard, root.Left, 2, false, 0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestWALRecover(t *testing.T) {
+	dir := t.TempDir()
+	snappath := filepath.Join(dir, "llrb.dump")
+	walpath := filepath.Join(dir, "llrb.wal")
+
+	ref := NewLLRB()
+	ref.SetDuplicates(true)
+	tree := NewLLRBMVCC(0)
+	tree.SetDuplicates(true)
+	wal, err := OpenWAL(walpath, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.SetWAL(wal)
+	for _, store := range []MemStore{ref, tree} {
+		for i := 0; i < 1000; i++ {
+			store.Upsert(&KeyInt{int64(i), int64(i)})
+		}
+	}
+	if err := tree.Checkpoint(snappath); err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := &KeyInt{int64(rnd.Intn(1200)), int64(i)}
+		switch rnd.Intn(10) {
+		case 0:
+			ref.Upsert(key)
+			tree.Upsert(key)
+		case 1:
+			ref.Insert(key)
+			tree.Insert(key)
+		case 2:
+			ref.Delete(key)
+			tree.Delete(key)
+		case 3:
+			ref.DeleteMin()
+			tree.DeleteMin()
+		case 4:
+			ref.DeleteMax()
+			tree.DeleteMax()
+		case 5:
+			match := func(x Item) bool { return x.(*KeyInt).Value%2 == 0 }
+			ref.DeleteDuplicate(key, match)
+			tree.DeleteDuplicate(key, match)
+		case 6:
+			incr := func(old Item) (Item, bool) {
+				if old == nil {
+					return key, true
+				}
+				kint := old.(*KeyInt)
+				return &KeyInt{kint.Key, kint.Value + 1}, kint.Value%3 != 0
+			}
+			ref.UpsertFunc(key, incr)
+			tree.UpsertFunc(key, incr)
+		case 7:
+			if items := ref.GetAll(key); len(items) > 0 {
+				ref.CompareAndSwap(items[len(items)-1], key)
+				items = tree.GetAll(key)
+				tree.CompareAndSwap(items[len(items)-1], key)
+			}
+		case 9:
+			batch := tree.Batch()
+			for j := int64(0); j < 6; j++ {
+				key := &KeyInt{key.Key + j, key.Value}
+				switch j {
+				case 0, 4:
+					ref.Upsert(key)
+					batch.Upsert(key)
+				case 1:
+					ref.Delete(key)
+					batch.Delete(key)
+				case 2:
+					ref.Insert(key)
+					batch.Insert(key)
+				case 3:
+					ref.DeleteMin()
+					batch.DeleteMin()
+				case 5:
+					ref.DeleteMax()
+					batch.DeleteMax()
+				}
+			}
+			batch.Commit()
+		case 8:
+			high := &KeyInt{key.Key + 5, 0}
+			ref.DeleteRange(key, high, "high")
+			tree.DeleteRange(key, high, "high")
+			ref.DeleteRange(nil, &KeyInt{-1, 0}, "none")
+			tree.DeleteRange(nil, &KeyInt{-1, 0}, "none")
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a torn write at the tail of the log.
+	info, err := os.Stat(walpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(walpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{0, 0, 0, 17, 1, 2, 3})
+	fd.Close()
+
+	recovered := NewLLRBMVCC(0)
+	recovered.SetDuplicates(true)
+	if err := recovered.Recover(snappath, walpath); err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Len() != ref.Len() {
+		t.Fatalf("expected %v, got %v", ref.Len(), recovered.Len())
+	}
+	validateTree(t, recovered.Root())
+	items := []Item{}
+	ref.Range(nil, nil, "both", func(item Item) bool {
+		items = append(items, item)
+		return true
+	})
+	recovered.Range(nil, nil, "both", func(item Item) bool {
+		if !reflect.DeepEqual(item, items[0]) {
+			t.Fatalf("expected %v, got %v", items[0], item)
+		}
+		items = items[1:]
+		return true
+	})
+	if after, _ := os.Stat(walpath); after.Size() != info.Size() {
+		t.Fatalf("expected torn tail truncated to %v, got %v", info.Size(), after.Size())
+	}
+
+	recover := func() (*LLRBMVCC, error) {
+		tree := NewLLRBMVCC(0)
+		tree.SetDuplicates(true)
+		return tree, tree.Recover(snappath, walpath)
+	}
+	writes := func(tree *LLRBMVCC, n int) {
+		wal, err := OpenWAL(walpath, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.SetWAL(wal)
+		for i := 0; i < n; i++ {
+			ref.DeleteMin()
+			tree.DeleteMin()
+			ref.Insert(&KeyInt{int64(i), -1})
+			tree.Insert(&KeyInt{int64(i), -1})
+		}
+		if err := wal.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crash after the dump is in place, and before the log is
+	// truncated, does not replay the log on top of the dump.
+	writes(recovered, 100)
+	log, err := os.ReadFile(walpath)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := recovered.Checkpoint(snappath); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(walpath, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err = recover(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(itemsOf(recovered), itemsOf(ref)) {
+		t.Fatalf("expected log to be skipped")
+	} else if info, _ := os.Stat(walpath); info.Size() != 0 {
+		t.Fatalf("expected log covered by dump to be emptied")
+	}
+	writes(recovered, 10)
+	recovered.wal.Close()
+	if recovered, err = recover(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(itemsOf(recovered), itemsOf(ref)) {
+		t.Fatalf("expected log to be replayed")
+	}
+
+	// corrupt record followed by valid records fails the recovery.
+	writes(recovered, 100)
+	recovered.wal.Close()
+	if log, err = os.ReadFile(walpath); err != nil {
+		t.Fatal(err)
+	}
+	good := append([]byte(nil), log...)
+	off := 0 // flip the last payload byte of a record in the middle
+	for off < len(log)/2 {
+		off += 8 + int(binary.BigEndian.Uint32(log[off:]))
+	}
+	log[off-1] ^= 0xff
+	if err := os.WriteFile(walpath, log, 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := recover(); err != ErrCorruptDump {
+		t.Fatalf("expected %v, got %v", ErrCorruptDump, err)
+	}
+
+	// garbage after the last record is a torn write, unless a valid
+	// record follows it.
+	first, last := 8+int(binary.BigEndian.Uint32(good)), 0
+	for off := 0; off < len(good); off += 8 + int(binary.BigEndian.Uint32(good[off:])) {
+		last = off
+	}
+	garbage := []byte{0, 0, 0, 3, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 0xff}
+	log = append(append([]byte(nil), good...), garbage...)
+	if err := os.WriteFile(walpath, log, 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := recover(); err != nil {
+		t.Fatal(err)
+	} else if info, _ := os.Stat(walpath); info.Size() != int64(len(good)) {
+		t.Fatalf("expected garbage truncated to %v, got %v", len(good), info.Size())
+	}
+	log = append(append(append([]byte(nil), good...), garbage...), good[last:]...)
+	if err := os.WriteFile(walpath, log, 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := recover(); err != ErrCorruptDump {
+		t.Fatalf("expected %v, got %v", ErrCorruptDump, err)
+	}
+
+	// log without a checkpoint record fails the recovery.
+	if err := os.WriteFile(walpath, good[first:], 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := recover(); err == nil {
+		t.Fatalf("expected log without checkpoint record to fail")
+	}
+
+	// log is not attached to a tree checkpointed after the log.
+	if err := os.WriteFile(walpath, good, 0644); err != nil {
+		t.Fatal(err)
+	} else if recovered, err = recover(); err != nil {
+		t.Fatal(err)
+	} else if err := recovered.Checkpoint(snappath); err != nil {
+		t.Fatal(err)
+	}
+	if wal, err = OpenWAL(walpath, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	recovered.SetWAL(wal)
+	recovered.Upsert(&KeyInt{1, 1})
+	if wal.Err() == nil {
+		t.Fatalf("expected log following an older checkpoint to fail")
+	}
+	wal.Close()
+	if info, _ := os.Stat(walpath); info.Size() != int64(len(good)) {
+		t.Fatalf("expected log not written")
+	}
+	if recovered, err = recover(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(itemsOf(recovered), itemsOf(ref)) {
+		t.Fatalf("expected log covered by dump to be skipped")
+	}
+
+	// records are fsync-ed in the background every syncinterval.
+	wal, err = OpenWAL(filepath.Join(dir, "interval.wal"), 1000, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.SetWAL(wal)
+	recovered.Upsert(&KeyInt{1, 1})
+	for i := 0; atomic.LoadInt32(&wal.dirty) != 0; i++ {
+		if i == 1000 {
+			t.Fatalf("expected records to be fsync-ed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkInsert(b *testing.B) {
 	tree := NewLLRB()
 	for i := 0; i < b.N; i++ {
@@ -3,20 +3,8 @@ package llrb
 // MemStore exposed by in-memory data-structure implementing
 // a sorted key-value store.
 type MemStore interface {
-	// Len return number of entries.
-	Len() int
-
-	// Has return whether Item is present in the store.
-	Has(key Item) bool
-
-	// Get return the Key-Value entry.
-	Get(key Item) Item
-
-	// Min return entry with lowest order.
-	Min() Item
-
-	// Max return entry with highest order.
-	Max() Item
+	// Read operations, Release on a writer returns ErrNotSnapshot.
+	Snapshot
 
 	// UpsertBulk will upsert 1 or more Key-Value entries.
 	UpsertBulk(keys ...Item)
@@ -30,6 +18,13 @@ type MemStore interface {
 	// Insert will insert 1 Key-Value entry.
 	Insert(key Item)
 
+	// UpsertFunc will insert, replace or leave untouched the
+	// Key-Value entry with same order as key, as decided by fn.
+	UpsertFunc(key Item, fn func(old Item) (Item, bool)) Item
+
+	// CompareAndSwap will replace Key-Value entry old with new.
+	CompareAndSwap(old, new Item) bool
+
 	// DeleteMin will remove Key-Value entry with lowest order.
 	DeleteMin() Item
 
@@ -39,8 +34,9 @@ type MemStore interface {
 	// Delete will remove the Key-Value entry with specified order.
 	Delete(key Item) Item
 
-	// Range will return a subset of sorted Key-Value entries.
-	Range(low, high Item, incl string, iter KeyIterator)
+	// DeleteRange will remove Key-Value entries between low
+	// and high, and return the number of removed entries.
+	DeleteRange(low, high Item, incl string) int
 
 	// GetHeight return the depth of a Key-Value entry with
 	// specified order.
@@ -50,12 +46,71 @@ type MemStore interface {
 	// of depths of all Key-Value entries.
 	HeightStats() (avg, stddev float64)
 
+	// Stats return storage statistics, number of entries, memory
+	// held by entries and nodes, and height statistics.
+	Stats() map[string]interface{}
+
 	// RSnapshot shall be called on writer instance and return
 	// a new snapshot instance that won't be disturbed by future
 	// writes.
-	RSnapshot(timeout int) MemStore
+	RSnapshot(timeout int) Snapshot
+}
+
+// Snapshot is a read-only version of a tree that won't be
+// disturbed by future writes, shall be released by calling
+// Release.
+type Snapshot interface {
+	// Len return number of entries.
+	Len() int
+
+	// Has return whether Item is present in the snapshot.
+	Has(key Item) bool
+
+	// Get return the Key-Value entry.
+	Get(key Item) Item
+
+	// Min return entry with lowest order.
+	Min() Item
+
+	// Max return entry with highest order.
+	Max() Item
+
+	// Floor return entry with highest order less than or
+	// equal to key.
+	Floor(key Item) Item
+
+	// Ceiling return entry with lowest order greater than or
+	// equal to key.
+	Ceiling(key Item) Item
+
+	// Lower return entry with highest order less than key.
+	Lower(key Item) Item
+
+	// Higher return entry with lowest order greater than key.
+	Higher(key Item) Item
+
+	// Range will return a subset of sorted Key-Value entries.
+	Range(low, high Item, incl string, iter KeyIterator)
+
+	// ReverseRange is same as Range, but walks the sorted
+	// Key-Value entries from high to low.
+	ReverseRange(low, high Item, incl string, iter KeyIterator)
+
+	// Cursor return a cursor positioned at the first entry.
+	Cursor() *Cursor
+
+	// Aggregate return the aggregate of entries between low
+	// and high, shall be called on trees configured with an
+	// aggregate.
+	Aggregate(low, high Item, incl string) Aggregate
+
+	// Release this snapshot and its resources, return
+	// ErrReleased if snapshot is already released.
+	Release() error
 
-	// Release this snapshot and its resources
+	// ReleaseSnapshot is same as Release, ignoring the error.
+	//
+	// Deprecated: use Release.
 	ReleaseSnapshot()
 }
 
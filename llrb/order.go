@@ -0,0 +1,119 @@
+package llrb
+
+// order statistics, computed in O(log n) using the number of
+// nodes maintained in each sub-tree.
+
+// Rank returns the number of elements in the tree whose order is
+// less than that of key, which is also the 0-based position of
+// key in sort order if it is present in the tree.
+func (t *LLRB) Rank(key Item) int {
+	return rankOf(t.root, key, false)
+}
+
+// Select returns the i-th element, 0-based, in sort order.
+// Returns nil if i is out of range.
+func (t *LLRB) Select(i int) Item {
+	return selectOf(t.root, i)
+}
+
+// CountRange returns the number of elements between low-key and
+// high-key, incl has the same semantics as that of Range.
+func (t *LLRB) CountRange(low, high Item, incl string) int {
+	return countRange(t.root, low, high, incl)
+}
+
+// Rank returns the number of elements in the tree whose order is
+// less than that of key, which is also the 0-based position of
+// key in sort order if it is present in the tree.
+func (t *LLRBMVCC) Rank(key Item) int {
+	return rankOf(t.Root(), key, false)
+}
+
+// Select returns the i-th element, 0-based, in sort order.
+// Returns nil if i is out of range.
+func (t *LLRBMVCC) Select(i int) Item {
+	return selectOf(t.Root(), i)
+}
+
+// CountRange returns the number of elements between low-key and
+// high-key, incl has the same semantics as that of Range.
+func (t *LLRBMVCC) CountRange(low, high Item, incl string) int {
+	return countRange(t.Root(), low, high, incl)
+}
+
+// rankOf returns the number of elements lesser than key, if
+// inclusive is true elements equal to key are also counted.
+func rankOf(h *Node, key Item, inclusive bool) int {
+	rank := 0
+	for h != nil {
+		var lesser bool
+		if inclusive {
+			lesser = !key.Less(h.Item)
+		} else {
+			lesser = h.Item.Less(key)
+		}
+		if lesser {
+			rank += countOf(h.Left) + liveOf(h)
+			h = h.Right
+		} else {
+			h = h.Left
+		}
+	}
+	return rank
+}
+
+func selectOf(h *Node, i int) Item {
+	if i < 0 {
+		return nil
+	}
+	for h != nil {
+		l := countOf(h.Left)
+		switch {
+		case i < l:
+			h = h.Left
+		case i == l && !h.Meta.dead:
+			return h.Item
+		default:
+			i, h = i-l-liveOf(h), h.Right
+		}
+	}
+	return nil
+}
+
+// liveOf returns 1 if h is live, 0 if it is a tombstone.
+func liveOf(h *Node) int {
+	if h.Meta.dead {
+		return 0
+	}
+	return 1
+}
+
+func countRange(h *Node, low, high Item, incl string) int {
+	if from, till := rankRange(h, low, high, incl); till > from {
+		return till - from
+	}
+	return 0
+}
+
+// rankRange returns the position of the first element between
+// low-key and high-key, and the position after the last element.
+func rankRange(h *Node, low, high Item, incl string) (from, till int) {
+	from, till = 0, countOf(h)
+	if low != nil {
+		switch incl {
+		case "low", "both":
+			from = rankOf(h, low, false)
+		default:
+			from = rankOf(h, low, true)
+		}
+	}
+	if high != nil {
+		switch incl {
+		case "high", "both":
+			till = rankOf(h, high, true)
+		default:
+			till = rankOf(h, high, false)
+		}
+	}
+	return from, till
+}
@@ -4,8 +4,10 @@ import "fmt"
 import "log"
 import "os"
 import "strings"
+import "sync"
 import "flag"
 import "time"
+import "runtime"
 import "math/rand"
 import "runtime/pprof"
 
@@ -20,6 +22,8 @@ var options struct {
 	ops     []string
 	algo    map[string]llrb.MemStore
 	mtick   int
+	slab    int
+	pools   map[string]*llrb.NodePool
 }
 
 var insInts = make([]llrb.Item, 0)
@@ -44,6 +48,8 @@ func argParse() {
 		"operations to profile")
 	flag.IntVar(&options.mtick, "mtick", 0,
 		"periodic tick to dump mem-stat, in mS")
+	flag.IntVar(&options.slab, "slab", 0,
+		"allocate nodes from slabs of this many nodes, 0 for heap")
 	flag.Parse()
 
 	options.ops = make([]string, 0)
@@ -54,15 +60,29 @@ func argParse() {
 		options.ops = append(options.ops, op)
 	}
 	options.algo = make(map[string]llrb.MemStore)
+	options.pools = make(map[string]*llrb.NodePool)
+	var slabs *llrb.SlabPool
+	if options.slab > 0 {
+		slabs = llrb.NewSlabPool(options.slab)
+	}
 	for _, algo := range strings.Split(algo, ",") {
 		if strings.Trim(algo, " ") == "" {
 			continue
 		}
+		var pool *llrb.NodePool
+		if slabs != nil {
+			pool = llrb.NewNodePool(slabs)
+			options.pools[algo] = pool
+		}
 		switch algo {
 		case "llrb":
-			options.algo[algo] = llrb.NewLLRB()
+			tree := llrb.NewLLRB()
+			tree.SetNodePool(pool)
+			options.algo[algo] = tree
 		case "mvcc":
-			options.algo[algo] = llrb.NewLLRBMVCC(10)
+			tree := llrb.NewLLRBMVCC(10)
+			tree.SetNodePool(pool)
+			options.algo[algo] = tree
 		}
 	}
 }
@@ -74,6 +94,7 @@ func main() {
 	}
 	initialize()
 	if len(options.ops) == 0 {
+		printAllocStats()
 		return
 	}
 
@@ -86,6 +107,8 @@ func main() {
 		"upsert": []interface{}{benchUpsert, len(upsInts)},
 		"range":  []interface{}{benchRange, count},
 		"delete": []interface{}{benchDelete, len(delInts)},
+		// snapshots taken by all readers.
+		"snapshot": []interface{}{benchSnapshot, count * options.readers},
 	}
 	for _, op := range options.ops {
 		if op == "" {
@@ -100,6 +123,17 @@ func main() {
 	}
 	takeMEMProfile(options.mprof)
 	pprof.StopCPUProfile()
+	printAllocStats()
+}
+
+func printAllocStats() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Printf("gc: %v cycles, %v pause, %v mallocs\n",
+		ms.NumGC, time.Duration(ms.PauseTotalNs), ms.Mallocs)
+	for name, pool := range options.pools {
+		fmt.Printf("%s pool: %v\n", name, pool.Stats())
+	}
 }
 
 func benchMin(s llrb.MemStore) {
@@ -138,6 +172,48 @@ func benchDelete(s llrb.MemStore) {
 	}
 }
 
+// benchSnapshot takes and releases snapshots from concurrent
+// readers, count snapshots per reader, while the writer keeps
+// upserting. Applicable only for mvcc.
+func benchSnapshot(s llrb.MemStore) {
+	tree, ok := s.(*llrb.LLRBMVCC)
+	if !ok {
+		return
+	}
+	var rwg, wwg sync.WaitGroup
+	done, writes := make(chan bool), 0
+	wwg.Add(1)
+	go func() {
+		defer wwg.Done()
+		now := time.Now()
+		for writes = 0; ; writes++ {
+			select {
+			case <-done:
+				fmsg := "mvcc.snapshot.upsert : %6d ns, %v writes\n"
+				ns := time.Since(now).Nanoseconds() / int64(max(writes, 1))
+				fmt.Printf(fmsg, ns, writes)
+				return
+			default:
+			}
+			tree.Upsert(upsInts[writes%len(upsInts)])
+		}
+	}()
+	for i := 0; i < options.readers; i++ {
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			for j := 0; j < options.bcount; j++ {
+				snapshot := tree.RSnapshot(1000)
+				snapshot.Get(getInts[j%len(getInts)])
+				snapshot.Release()
+			}
+		}()
+	}
+	rwg.Wait()
+	close(done)
+	wwg.Wait()
+}
+
 func timeit(fmsg string, fn func(), count int) {
 	now := time.Now()
 	fn()
@@ -149,11 +225,15 @@ func initialize() {
 		startCPUProfile(options.pprof)
 	}
 	for name, store := range options.algo {
+		items := make([]llrb.Item, 0, options.bcount)
 		for i := 0; i < options.bcount; i++ {
 			item := &llrb.KeyInt{int64(i), time.Now().UnixNano()}
-			store.Insert(item)
+			items = append(items, item)
 		}
-		fmt.Printf("inserted %d items into %s\n", store.Len(), name)
+		now := time.Now()
+		store.InsertBulk(items...)
+		fmt.Printf("inserted %d items into %s in %v\n",
+			store.Len(), name, time.Since(now))
 	}
 
 	if len(options.ops) > 0 {
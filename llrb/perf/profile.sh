@@ -7,6 +7,7 @@ go build || exit 1
 #./perf -algo mvcc -ops upsert -count $count -pprof llrb.upsert.pprof -mprof llrb.upsert.mprof
 #./perf -algo mvcc -ops range -count $count -pprof llrb.range.pprof -mprof llrb.upsert.mprof
 #./perf -algo mvcc -ops delete -count $count -pprof llrb.del.pprof -mprof llrb.del.mprof
+#./perf -algo mvcc -ops snapshot -readers 8 -count $count -pprof llrb.snapshot.pprof
 
 files=initial # min max get upsert range del
 for file in $files; do
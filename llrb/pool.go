@@ -0,0 +1,387 @@
+package llrb
+
+import "sort"
+import "sync"
+import "unsafe"
+
+// memory pool for tree nodes. Nodes are allocated in slabs, each
+// slab is a block of nodes allocated in a single go, from a
+// SlabPool that can be shared by many writers. Each writer
+// allocates nodes from its own NodePool, which does not lock, and
+// locks the SlabPool only when it needs a new slab or frees a slab.
+// NodePool keeps a free-list per slab, linked via the Left pointer,
+// and counts the nodes of a slab in use. Freed nodes are reused
+// before allocating from a new slab, and a slab whose nodes are all
+// freed is returned to the SlabPool, which hands it out again to
+// any writer. A slab stays in memory as long as any of its nodes
+// is in use. Without a SlabPool, nodes are allocated from heap and
+// a bounded number of freed nodes are kept for reuse. Extended
+// nodes, refer nodeX, are always allocated from heap and reused the
+// same way. Nodes are stamped with the pool's generation, once a
+// generation is expired its nodes, and its slabs, are left to the
+// garbage collector instead of being reused, since they might be
+// reachable by expired snapshots.
+
+// maxFreeSlabs is the number of free slabs kept by SlabPool for
+// reuse, rest are left to the garbage collector.
+const maxFreeSlabs = 64
+
+// maxFreeNodes is the number of freed nodes kept by NodePool for
+// reuse, when allocating from heap.
+const maxFreeNodes = 1 << 14
+
+// SlabPool manages slabs of nodes for several NodePools, it is
+// safe for concurrent use.
+type SlabPool struct {
+	mu       sync.Mutex
+	slabsize int
+	free     [][]Node
+	nallocs  int64
+	nfrees   int64
+}
+
+// NewSlabPool creates a pool of slabs, each slab holding slabsize
+// nodes.
+func NewSlabPool(slabsize int) *SlabPool {
+	if slabsize <= 0 {
+		panic("slabsize shall be greater than zero")
+	}
+	return &SlabPool{slabsize: slabsize, free: make([][]Node, 0)}
+}
+
+// Alloc returns a slab of zero nodes, reusing a freed slab if any.
+func (s *SlabPool) Alloc() []Node {
+	s.mu.Lock()
+	s.nallocs++
+	if n := len(s.free); n > 0 {
+		slab := s.free[n-1]
+		s.free = s.free[:n-1]
+		s.mu.Unlock()
+		return slab
+	}
+	s.mu.Unlock()
+	return make([]Node, s.slabsize)
+}
+
+// Free returns slab, allocated by Alloc, to the pool. None of its
+// nodes shall be in use.
+func (s *SlabPool) Free(slab []Node) {
+	if len(slab) != s.slabsize {
+		panic("freeing a slab of different size")
+	}
+	clear(slab)
+	s.mu.Lock()
+	s.nfrees++
+	if len(s.free) < maxFreeSlabs {
+		s.free = append(s.free, slab)
+	}
+	s.mu.Unlock()
+}
+
+// Stats returns statistics of the slab pool,
+//
+//	"slab.size"     : number of nodes in a slab.
+//	"slab.alloc"    : number of slabs allocated.
+//	"slab.free"     : number of slabs freed.
+//	"slab.freelist" : number of free slabs waiting to be reused.
+func (s *SlabPool) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"slab.size":     s.slabsize,
+		"slab.alloc":    s.nallocs,
+		"slab.free":     s.nfrees,
+		"slab.freelist": int64(len(s.free)),
+	}
+}
+
+// NodePool allocates nodes for a single writer, it is not safe
+// for concurrent use. A nil NodePool allocates nodes from heap.
+type NodePool struct {
+	slabs     *SlabPool
+	held      []*slab // slabs with nodes in use, sorted by address
+	avail     []*slab // held slabs with nodes to allocate
+	freelist  *Node   // freed nodes, when allocating from heap
+	xfreelist *Node   // freed extended nodes
+	nfree     int64   // number of freed nodes waiting to be reused
+	nxfree    int64   // number of freed extended nodes waiting to be reused
+	nslabs    int64
+	nslabfree int64
+	nfresh    int64
+	nrecycled int64
+	nfrees    int64
+	ndropped  int64
+	gen       uint32
+}
+
+// slab of nodes held by a NodePool.
+type slab struct {
+	nodes    []Node
+	next     int   // nodes from next are not yet allocated
+	used     int   // number of nodes in use
+	freelist *Node // freed nodes of this slab
+	avail    int   // index in NodePool.avail, -1 if not available
+}
+
+// NewNodePool creates a pool of nodes, allocating slabs from
+// slabs. If slabs is nil, nodes are allocated from heap, and
+// freed nodes are still reused.
+func NewNodePool(slabs *SlabPool) *NodePool {
+	return &NodePool{slabs: slabs}
+}
+
+// Stats returns statistics of the node pool,
+//
+//	"node.alloc"    : number of nodes allocated.
+//	"node.fresh"    : number of nodes allocated from slab or heap.
+//	"node.recycled" : number of nodes allocated from freed nodes.
+//	"node.free"     : number of nodes freed.
+//	"node.freelist" : number of freed nodes waiting to be reused.
+//	"node.dropped"  : number of freed nodes left to the garbage
+//	                  collector, from expired generations.
+//	"node.slabs"    : number of slabs allocated by this pool.
+//	"node.slabfree" : number of slabs freed back to the slab pool.
+func (p *NodePool) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"node.alloc":    p.nfresh + p.nrecycled,
+		"node.fresh":    p.nfresh,
+		"node.recycled": p.nrecycled,
+		"node.free":     p.nfrees,
+		"node.freelist": p.nfree,
+		"node.dropped":  p.ndropped,
+		"node.slabs":    p.nslabs,
+		"node.slabfree": p.nslabfree,
+	}
+}
+
+func (p *NodePool) alloc() *Node {
+	if p.slabs == nil {
+		return p.allocHeap()
+	} else if len(p.avail) == 0 {
+		p.hold(p.slabs.Alloc())
+	}
+	s := p.avail[len(p.avail)-1]
+	h := s.freelist
+	if h != nil {
+		s.freelist, h.Left = h.Left, nil
+		p.nfree--
+		p.nrecycled++
+	} else {
+		h = &s.nodes[s.next]
+		s.next++
+		p.nfresh++
+	}
+	s.used++
+	if s.freelist == nil && s.next == len(s.nodes) {
+		p.unavail(s)
+	}
+	h.Meta.gen = p.gen
+	return h
+}
+
+func (p *NodePool) allocHeap() *Node {
+	if h := p.freelist; h != nil {
+		p.freelist, h.Left = h.Left, nil
+		p.nfree--
+		p.nrecycled++
+		h.Meta.gen = p.gen
+		return h
+	}
+	p.nfresh++
+	return &Node{Meta: meta{gen: p.gen}}
+}
+
+func (p *NodePool) allocX() *Node {
+	if h := p.xfreelist; h != nil {
+		p.xfreelist, h.Left = h.Left, nil
+		p.nfree, p.nxfree = p.nfree-1, p.nxfree-1
+		p.nrecycled++
+		h.Meta.gen = p.gen
+		return h
+	}
+	p.nfresh++
+	x := &nodeX{}
+	x.Meta.ext, x.Meta.gen = true, p.gen
+	return &x.Node
+}
+
+// free returns node h to the pool, it shall not be referred by
+// any tree or snapshot.
+func (p *NodePool) free(h *Node) {
+	if p == nil {
+		return
+	} else if h.Meta.gen != p.gen {
+		p.ndropped++
+		return
+	}
+	p.nfrees++
+	if h.Meta.ext {
+		if p.nxfree < maxFreeNodes {
+			x := (*nodeX)(unsafe.Pointer(h))
+			*x = nodeX{Node: Node{Left: p.xfreelist, Meta: meta{ext: true, gen: p.gen}}}
+			p.xfreelist = h
+			p.nfree, p.nxfree = p.nfree+1, p.nxfree+1
+		}
+		return
+	} else if p.slabs == nil {
+		if p.nfree < maxFreeNodes {
+			*h = Node{Left: p.freelist, Meta: meta{gen: p.gen}}
+			p.freelist = h
+			p.nfree++
+		}
+		return
+	}
+	s := p.slabOf(h)
+	if s == nil { // not allocated by this pool
+		return
+	}
+	*h = Node{Left: s.freelist, Meta: meta{gen: p.gen}}
+	s.freelist = h
+	s.used--
+	p.nfree++
+	if s.avail < 0 {
+		s.avail, p.avail = len(p.avail), append(p.avail, s)
+	}
+	if s.used == 0 && len(p.avail) > 1 { // keep one slab for reuse
+		p.release(s)
+	}
+}
+
+// hold adds a new slab to the pool.
+func (p *NodePool) hold(nodes []Node) {
+	s := &slab{nodes: nodes, avail: len(p.avail)}
+	p.avail = append(p.avail, s)
+	i := sort.Search(len(p.held), func(i int) bool {
+		return addressOf(p.held[i]) > addressOf(s)
+	})
+	p.held = append(p.held, nil)
+	copy(p.held[i+1:], p.held[i:])
+	p.held[i] = s
+	p.nslabs++
+}
+
+// release frees slab s, whose nodes are all freed, back to the slab
+// pool.
+func (p *NodePool) release(s *slab) {
+	p.unavail(s)
+	i := sort.Search(len(p.held), func(i int) bool {
+		return addressOf(p.held[i]) >= addressOf(s)
+	})
+	p.held = append(p.held[:i], p.held[i+1:]...)
+	p.nfree -= int64(s.next)
+	p.nslabfree++
+	p.slabs.Free(s.nodes)
+}
+
+func (p *NodePool) unavail(s *slab) {
+	last := p.avail[len(p.avail)-1]
+	p.avail[s.avail], last.avail = last, s.avail
+	p.avail = p.avail[:len(p.avail)-1]
+	s.avail = -1
+}
+
+// slabOf returns the slab holding node h, nil if h is not from a
+// slab held by this pool.
+func (p *NodePool) slabOf(h *Node) *slab {
+	addr := uintptr(unsafe.Pointer(h))
+	i := sort.Search(len(p.held), func(i int) bool {
+		return addressOf(p.held[i]) > addr
+	})
+	if i == 0 {
+		return nil
+	}
+	s := p.held[i-1]
+	if addr-addressOf(s) >= uintptr(len(s.nodes))*unsafe.Sizeof(Node{}) {
+		return nil
+	}
+	return s
+}
+
+func addressOf(s *slab) uintptr {
+	return uintptr(unsafe.Pointer(&s.nodes[0]))
+}
+
+// freeTree returns all nodes in the sub-tree rooted at h to the
+// pool.
+func (p *NodePool) freeTree(h *Node) {
+	if p == nil || h == nil {
+		return
+	}
+	p.freeTree(h.Left)
+	p.freeTree(h.Right)
+	p.free(h)
+}
+
+// newNode allocates a node for key, extended if ext is true.
+func (p *NodePool) newNode(key Item, ext bool) *Node {
+	if p == nil && ext {
+		return newNodeX(key)
+	} else if p == nil {
+		return newNode(key)
+	}
+	var h *Node
+	if ext {
+		h = p.allocX()
+	} else {
+		h = p.alloc()
+	}
+	h.Item = key
+	updateNode(h)
+	return h
+}
+
+// cow copies node h, the copy is extended if h is extended or if
+// ext is true.
+func (p *NodePool) cow(h *Node, ext bool) *Node {
+	if p == nil || h == nil {
+		return cow(h, ext)
+	}
+	var hnew *Node
+	if h.Meta.ext {
+		hnew = p.allocX()
+		*(*nodeX)(unsafe.Pointer(hnew)) = *(*nodeX)(unsafe.Pointer(h))
+	} else if ext {
+		hnew = p.allocX()
+		*hnew = *h
+		hnew.Meta.ext = true
+	} else {
+		hnew = p.alloc()
+		*hnew = *h
+	}
+	hnew.Meta.gen = p.gen
+	return hnew
+}
+
+// expire starts a new generation, nodes allocated so far, and
+// their slabs, are not reused.
+func (p *NodePool) expire() {
+	if p != nil {
+		p.gen++
+		p.abandon()
+	}
+}
+
+// abandon leaves slabs held by the pool to the garbage collector.
+func (p *NodePool) abandon() {
+	for _, s := range p.held {
+		p.nfree -= int64(s.next - s.used)
+	}
+	p.held, p.avail = nil, nil
+}
+
+// generation returns the current generation of the pool.
+func (p *NodePool) generation() uint32 {
+	if p == nil {
+		return 0
+	}
+	return p.gen
+}
+
+// inherit makes nodes allocated from other pools, upto generation
+// gen, not reused by this pool.
+func (p *NodePool) inherit(gen uint32) {
+	if p != nil && p.gen < gen {
+		p.gen = gen
+		p.abandon()
+	}
+}
@@ -0,0 +1,134 @@
+package llrb
+
+import "context"
+import "errors"
+import "runtime/debug"
+import "sync/atomic"
+import "time"
+import "unsafe"
+
+// reader accounting, epoch based. Snapshots acquired between two
+// writes that reclaim nodes belong to the same epoch. Writer keeps
+// the current epoch number, along with the number of readers that
+// entered it, in a single word, a reader enters the epoch with an
+// atomic add on that word and leaves it with an atomic add on the
+// epoch, hence acquire and release are wait-free and the number of
+// readers is not limited. When a write reclaims nodes, after the
+// new root is published, writer closes the current epoch, if any
+// reader entered it, by swapping in the next epoch and learns the
+// exact number of readers that entered the closed epoch. Nodes
+// reclaimed while an epoch is the latest closed one are held for
+// its readers, and are recycled once it is drained, or are handed
+// over to the previous epoch that is not drained. Readers entering
+// after the swap can only see the new root.
+
+// ErrReleased is returned when a snapshot is released more than
+// once.
+var ErrReleased = errors.New("llrb: snapshot already released")
+
+// ErrExpired is returned when a snapshot, expired by the writer,
+// is released.
+var ErrExpired = errors.New("llrb: snapshot expired")
+
+// ErrNotSnapshot is returned when a writer is released.
+var ErrNotSnapshot = errors.New("llrb: not a snapshot")
+
+// ErrTooManyReaders was returned when all reader slots were taken.
+//
+// Deprecated: number of readers is not limited, this error is no
+// more returned.
+var ErrTooManyReaders = errors.New("llrb: too many readers")
+
+// ErrTimeout was returned when a reader slot was not available
+// before ctx deadline.
+//
+// Deprecated: acquiring a snapshot never waits, RSnapshotContext
+// returns ctx.Err() if ctx is already done, ErrTimeout is same as
+// context.DeadlineExceeded.
+var ErrTimeout = context.DeadlineExceeded
+
+// epoch number is kept in the upper bits, and the number of readers
+// entered in the lower bits, of LLRBMVCC.state.
+const epochShift = 40
+const epochMask = 1<<(64-epochShift) - 1
+const enteredMask = 1<<epochShift - 1
+
+type epoch struct {
+	id    uint64
+	seqno uint64         // seqno of the tree when epoch started
+	next  unsafe.Pointer // *epoch, set before epoch is closed
+	// set by writer when epoch is closed.
+	entered uint64
+	expired int32
+	// updated by readers.
+	left     uint64         // number of readers released
+	acquired int64          // when the first reader entered, unix nano
+	records  unsafe.Pointer // *record, latest first, if stacks enabled
+}
+
+// record of a snapshot, kept only when stacks are enabled, so that
+// a leaked snapshot can be attributed to the goroutine acquiring it.
+type record struct {
+	acquired int64 // unix nano
+	stack    []byte
+	released int32
+	next     *record // record of previous snapshot in the same epoch
+}
+
+// enter adds a reader to the current epoch, and returns the epoch
+// along with the snapshot's record, if stacks are enabled. Writer
+// links the next epoch before it swaps the epoch number and
+// publishes the next epoch after the swap, hence the epoch loaded
+// before entering is same as, or older than, the epoch entered.
+func (t *LLRBMVCC) enter() (*epoch, *record) {
+	e := (*epoch)(atomic.LoadPointer(&t.epoch))
+	id := atomic.AddUint64(&t.state, 1) >> epochShift
+	for e.id != id {
+		e = (*epoch)(atomic.LoadPointer(&e.next))
+	}
+	now := time.Now().UnixNano()
+	if atomic.LoadInt64(&e.acquired) == 0 {
+		atomic.CompareAndSwapInt64(&e.acquired, 0, now)
+	}
+	if !t.stacks {
+		return e, nil
+	}
+	r := &record{acquired: now, stack: debug.Stack()}
+	for {
+		next := atomic.LoadPointer(&e.records)
+		r.next = (*record)(next)
+		if atomic.CompareAndSwapPointer(&e.records, next, unsafe.Pointer(r)) {
+			return e, r
+		}
+	}
+}
+
+// advance closes the current epoch, if any reader entered it, and
+// returns the same. Shall be called by the writer.
+func (t *LLRBMVCC) advance() *epoch {
+	if atomic.LoadUint64(&t.state)&enteredMask == 0 {
+		return nil
+	}
+	e := (*epoch)(atomic.LoadPointer(&t.epoch))
+	next := &epoch{id: (e.id + 1) & epochMask, seqno: t.seqno}
+	atomic.StorePointer(&e.next, unsafe.Pointer(next))
+	state := atomic.SwapUint64(&t.state, next.id<<epochShift)
+	atomic.StorePointer(&t.epoch, unsafe.Pointer(next))
+	e.entered = state & enteredMask
+	return e
+}
+
+// readers returns the number of unreleased snapshots in a closed
+// epoch, none if the epoch is expired.
+func (e *epoch) readers() int {
+	if atomic.LoadInt32(&e.expired) == 1 {
+		return 0
+	}
+	return int(e.entered - atomic.LoadUint64(&e.left))
+}
+
+// drained returns true if all readers of a closed epoch are
+// released, or the epoch is expired.
+func (e *epoch) drained() bool {
+	return e.readers() == 0
+}
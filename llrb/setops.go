@@ -0,0 +1,153 @@
+package llrb
+
+// set algebra between trees. Elements of both trees are merged in
+// sort order, walking each tree once with a cursor, and the result
+// is built bottom up, in O(n+m). When trees allow duplicates, they
+// are treated as multisets, and the i-th element of same order in
+// one tree pairs with the i-th element of same order in the other.
+
+// Conflict resolves a pair of elements of same order, from left
+// and right trees, into the element retained by the result. It
+// may return nil to leave out the pair, otherwise the returned
+// element shall be of same order as the pair. A nil Conflict is
+// same as LeftWins.
+type Conflict func(left, right Item) Item
+
+// LeftWins is a Conflict rule that retains element from left tree.
+func LeftWins(left, right Item) Item { return left }
+
+// RightWins is a Conflict rule that retains element from right tree.
+func RightWins(left, right Item) Item { return right }
+
+const (
+	setUnion = iota
+	setIntersection
+	setDifference
+)
+
+// Union returns a new tree with elements from this tree and other.
+// Other can be any Snapshot, including a snapshot of LLRBMVCC.
+func (t *LLRB) Union(other Snapshot, conflict Conflict) *LLRB {
+	return t.setop(other, setUnion, conflict)
+}
+
+// Intersection returns a new tree with elements of same order
+// present in both this tree and other.
+func (t *LLRB) Intersection(other Snapshot, conflict Conflict) *LLRB {
+	return t.setop(other, setIntersection, conflict)
+}
+
+// Difference returns a new tree with elements from this tree,
+// whose order is not present in other. When trees allow
+// duplicates, each element in other removes one element of same
+// order from this tree, in insertion order, hence if this tree has
+// n elements of an order and other has m, the last n-m of them are
+// retained.
+func (t *LLRB) Difference(other Snapshot) *LLRB {
+	return t.setop(other, setDifference, nil)
+}
+
+func (t *LLRB) setop(other Snapshot, op int, conflict Conflict) *LLRB {
+	items := mergeSets(t.Cursor(), other.Cursor(), t.Len(), other.Len(), op, conflict)
+	newt := NewLLRB()
+	newt.derive(t.agg, t.intervals)
+	newt.root, newt.count, newt.dups = buildTree(&newt.algo, items, newt.newNode), len(items), t.dups || duplicatesOf(other)
+	return newt
+}
+
+// Union returns a new tree with elements from this tree and
+// other. Can be called on the writer or on a snapshot.
+func (t *LLRBMVCC) Union(other Snapshot, conflict Conflict) *LLRBMVCC {
+	return t.setop(other, setUnion, conflict)
+}
+
+// Intersection returns a new tree with elements of same order
+// present in both this tree and other.
+func (t *LLRBMVCC) Intersection(other Snapshot, conflict Conflict) *LLRBMVCC {
+	return t.setop(other, setIntersection, conflict)
+}
+
+// Difference returns a new tree with elements from this tree,
+// whose order is not present in other. When trees allow
+// duplicates, each element in other removes one element of same
+// order from this tree, in insertion order, hence if this tree has
+// n elements of an order and other has m, the last n-m of them are
+// retained.
+func (t *LLRBMVCC) Difference(other Snapshot) *LLRBMVCC {
+	return t.setop(other, setDifference, nil)
+}
+
+func (t *LLRBMVCC) setop(other Snapshot, op int, conflict Conflict) *LLRBMVCC {
+	items := mergeSets(t.Cursor(), other.Cursor(), t.Len(), other.Len(), op, conflict)
+	newt := NewLLRBMVCC(0)
+	newt.derive(t.agg, t.intervals)
+	newt.SetRoot(buildTree(&newt.algo, items, newt.newNode))
+	newt.count, newt.dups = len(items), t.dups || duplicatesOf(other)
+	return newt
+}
+
+// duplicatesOf returns whether store allows duplicates, stores
+// that can't tell are assumed to not allow them.
+func duplicatesOf(store Snapshot) bool {
+	dups, ok := store.(interface{ Duplicates() bool })
+	return ok && dups.Duplicates()
+}
+
+// mergeSets merges n elements from cursor x and m elements from
+// cursor y in sort order, as per op. Both cursors shall be
+// positioned on their minimum element.
+func mergeSets(x, y *Cursor, n, m, op int, conflict Conflict) []Item {
+	if conflict == nil {
+		conflict = LeftWins
+	}
+
+	var items []Item
+	switch op {
+	case setUnion:
+		items = make([]Item, 0, n+m)
+	case setIntersection:
+		items = make([]Item, 0, min(n, m))
+	default:
+		items = make([]Item, 0, n)
+	}
+
+	for x.Valid() && y.Valid() {
+		l, r := x.Item(), y.Item()
+		switch {
+		case l.Less(r):
+			if op != setIntersection {
+				items = append(items, l)
+			}
+			x.Next()
+		case r.Less(l):
+			if op == setUnion {
+				items = append(items, r)
+			}
+			y.Next()
+		default:
+			if op != setDifference {
+				items = resolve(items, l, r, conflict)
+			}
+			x.Next()
+			y.Next()
+		}
+	}
+	for ; x.Valid() && op != setIntersection; x.Next() {
+		items = append(items, x.Item())
+	}
+	for ; y.Valid() && op == setUnion; y.Next() {
+		items = append(items, y.Item())
+	}
+	return items
+}
+
+// resolve appends the element retained by conflict for l and r.
+func resolve(items []Item, l, r Item, conflict Conflict) []Item {
+	item := conflict(l, r)
+	if item == nil {
+		return items
+	} else if item.Less(l) || l.Less(item) {
+		panic("conflict shall return an item of same order")
+	}
+	return append(items, item)
+}
@@ -0,0 +1,238 @@
+package llrb
+
+// split and join of LLRB trees. A tree is split by descending the
+// path that separates the two halves, and joining the sub-trees
+// hanging off that path. Two trees, and a middle node, are joined
+// by descending the spine of the taller tree to a black node of
+// same black height as the shorter tree, and attaching them there
+// as a red node, much like an insert, in O(1 + difference of black
+// heights). Since black heights are passed down while splitting,
+// the cost of joins along the path telescopes and both take
+// O(log n). LLRB and LLRBMVCC share the same routines, nodes of an
+// LLRBMVCC are copied by its algo before they are modified.
+
+// Split splits the tree into a tree with elements whose order is
+// less than key, and a tree with rest of the elements, in O(log n).
+// Nodes are moved to the new trees, leaving this tree empty.
+func (t *LLRB) Split(key Item) (left, right *LLRB) {
+	i := rankOf(t.root, key, false)
+	l, _, r, _ := splitTree(&t.algo, t.root, i, blackHeight(t.root))
+	left, right = NewLLRB(), NewLLRB()
+	left.derive(t.agg, t.intervals)
+	right.derive(t.agg, t.intervals)
+	left.root, left.count, left.dups = l, i, t.dups
+	right.root, right.count, right.dups = r, t.count-i, t.dups
+	t.root, t.count = nil, 0
+	return left, right
+}
+
+// Join concatenates left and right trees into a new tree, in
+// O(log n). Elements of left shall be ordered before elements of
+// right, elements of same order are allowed only if either tree
+// allows duplicates. Both trees shall be configured with the same
+// aggregate and intervals. Nodes are moved to the new tree, leaving
+// both left and right empty.
+func Join(left, right *LLRB) *LLRB {
+	dups := left.dups || right.dups
+	same := sameAggregator(left.agg, right.agg) && left.intervals == right.intervals
+	checkJoin(left, right, left.Max(), right.Min(), dups, same)
+	t := NewLLRB()
+	t.derive(left.agg, left.intervals)
+	t.root, t.dups = concatTree(&t.algo, left.root, right.root), dups
+	t.count = left.count + right.count
+	left.root, left.count = nil, 0
+	right.root, right.count = nil, 0
+	return t
+}
+
+// Split is same as LLRB.Split, except that nodes are copied before
+// they are modified, so that snapshots of this tree are not
+// disturbed. Shall be called on the writer. Nodes reclaimed by new
+// trees are recycled only after snapshots of this tree are
+// released. If tombstones are enabled, they are purged before the
+// split, in O(n), and the new trees keep tombstones as well.
+func (t *LLRBMVCC) Split(key Item) (left, right *LLRBMVCC) {
+	if t.reader != nil {
+		panic("cannot split a snapshot")
+	} else if t.tombs {
+		t.purge(t.written)
+	}
+	root := t.Root()
+	i := rankOf(root, key, false)
+	l, _, r, _ := splitTree(&t.algo, root, i, blackHeight(root))
+	reclaim, count := t.reclaim, t.count
+	t.reclaim = nil
+	t.clear() // before handover, later snapshots shall see it empty
+	t.reclaimNodes("split", reclaim)
+	left, right = NewLLRBMVCC(0), NewLLRBMVCC(0)
+	left.derive(t.agg, t.intervals)
+	right.derive(t.agg, t.intervals)
+	left.pool.inherit(t.pool.generation())
+	right.pool.inherit(t.pool.generation())
+	pinned := t.handover()
+	left.pin(pinned)
+	right.pin(newReclaimed(pinned.epochs...))
+	left.SetRoot(l)
+	left.count, left.dups, left.tombs = i, t.dups, t.tombs
+	right.SetRoot(r)
+	right.count, right.dups, right.tombs = count-i, t.dups, t.tombs
+	return left, right
+}
+
+// JoinMVCC is same as Join, except that nodes are copied before
+// they are modified, so that snapshots of left and right are not
+// disturbed. Shall be called on writers. Nodes reclaimed by new
+// tree are recycled only after snapshots of left and right are
+// released. Tombstones of left and right are purged before the
+// join, in O(n), new tree keeps tombstones if either of them did.
+func JoinMVCC(left, right *LLRBMVCC) *LLRBMVCC {
+	if left.reader != nil || right.reader != nil {
+		panic("cannot join snapshots")
+	}
+	for _, tree := range []*LLRBMVCC{left, right} {
+		if tree.tombs {
+			tree.purge(tree.written)
+		}
+	}
+	dups := left.dups || right.dups
+	same := sameAggregator(left.agg, right.agg) && left.intervals == right.intervals
+	checkJoin(left, right, left.Max(), right.Min(), dups, same)
+	root := concatTree(&left.algo, left.Root(), right.Root())
+	reclaim := left.reclaim
+	left.reclaim = nil
+	t := NewLLRBMVCC(0)
+	t.derive(left.agg, left.intervals)
+	t.pool.inherit(max(left.pool.generation(), right.pool.generation()))
+	t.SetRoot(root)
+	t.count, t.dups = left.count+right.count, dups
+	t.tombs = left.tombs || right.tombs
+	left.clear() // before handover, later snapshots shall see it empty
+	right.clear()
+	r, rr := left.handover(), right.handover()
+	r.epochs = append(r.epochs, rr.epochs...)
+	r.nodes = append(r.nodes, rr.nodes...)
+	t.pin(r)
+	t.reclaimNodes("join", reclaim)
+	return t
+}
+
+// clear empties the writer after its nodes are moved to other trees.
+func (t *LLRBMVCC) clear() {
+	if t.count > 0 {
+		t.logRange(walDeleteRange, nil, nil, "none")
+	}
+	t.SetRoot(nil)
+	t.count = 0
+}
+
+func checkJoin(left, right MemStore, max, min Item, dups, same bool) {
+	if left == right {
+		panic("cannot join a tree with itself")
+	} else if !same {
+		panic("cannot join trees with different aggregate or intervals")
+	} else if max == nil || min == nil {
+		return
+	} else if min.Less(max) || (!dups && !max.Less(min)) {
+		panic("cannot join trees with overlapping keys")
+	}
+}
+
+// blackHeight returns the number of black nodes from h to a leaf.
+func blackHeight(h *Node) int {
+	n := 0
+	for ; h != nil; h = h.Left {
+		if !isRed(h) {
+			n++
+		}
+	}
+	return n
+}
+
+// splitTree splits the tree rooted at h, of black height bh, into
+// two trees, the first i elements go to the left tree and the rest
+// go to the right tree. Returns the trees along with their black
+// heights.
+func splitTree(a *algo, h *Node, i, bh int) (*Node, int, *Node, int) {
+	if h == nil {
+		return nil, 0, nil, 0
+	}
+	left, right, n := h.Left, h.Right, countOf(h.Left)
+	lh, rh := childHeights(h, bh)
+	if isRed(left) {
+		left = a.Own(left)
+		left.Black = true
+	}
+	m := a.Own(h)
+	m.Left, m.Right, m.Black = nil, nil, false
+	if i > n {
+		l, lbh, r, rbh := splitTree(a, right, i-n-1, rh)
+		l, lbh = joinTree(a, left, m, l, lh, lbh)
+		return l, lbh, r, rbh
+	}
+	l, lbh, r, rbh := splitTree(a, left, i, lh)
+	r, rbh = joinTree(a, r, m, right, rbh, rh)
+	return l, lbh, r, rbh
+}
+
+// childHeights returns the black heights of children of h, of
+// black height bh, when they are made roots of their own trees.
+func childHeights(h *Node, bh int) (lh, rh int) {
+	if !isRed(h) {
+		bh--
+	}
+	if lh = bh; isRed(h.Left) {
+		lh++
+	}
+	return lh, bh
+}
+
+// joinTree joins trees rooted at l and r, with black roots and of
+// black heights lh and rh, using m as the middle node. Elements of
+// l shall be ordered before m, and m before elements of r. Returns
+// the joined tree along with its black height.
+func joinTree(a *algo, l, m, r *Node, lh, rh int) (*Node, int) {
+	h, bh := join(a, l, m, r, lh, rh), max(lh, rh)
+	if isRed(h) {
+		h.Black, bh = true, bh+1
+	}
+	return h, bh
+}
+
+func join(a *algo, l, m, r *Node, lh, rh int) *Node {
+	if lh > rh {
+		if !isRed(l) {
+			lh--
+		}
+		l = a.Own(l)
+		l.Right = join(a, l.Right, m, r, lh, rh)
+		return a.WalkUp(l)
+	} else if lh < rh || isRed(r) {
+		if !isRed(r) {
+			rh--
+		}
+		r = a.Own(r)
+		r.Left = join(a, l, m, r.Left, lh, rh)
+		return a.WalkUp(r)
+	}
+	m.Left, m.Right, m.Black = l, r, false
+	a.Update(m)
+	return m
+}
+
+// concatTree joins trees rooted at l and r, with black roots,
+// elements of l shall be ordered before elements of r.
+func concatTree(a *algo, l, r *Node) *Node {
+	if l == nil {
+		return r
+	} else if r == nil {
+		return l
+	}
+	r, m := a.DeleteMin(r)
+	if isRed(r) {
+		r.Black = true // r is owned by DeleteMin
+	}
+	m = a.Own(m)
+	m.Left, m.Right = nil, nil
+	h, _ := joinTree(a, l, m, r, blackHeight(l), blackHeight(r))
+	return h
+}
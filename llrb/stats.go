@@ -0,0 +1,139 @@
+package llrb
+
+import "sync/atomic"
+import "unsafe"
+
+import "github.com/prataprc/golib"
+
+// storage stats. Size of items is maintained in every node along
+// with the sub-tree count, hence it is always accurate, including
+// after bulk loads, range deletes, splits and joins. Node overhead
+// is estimated from the number of nodes.
+
+// nodeSize is the memory used by a node, excluding its item, and
+// nodeXSize is the memory used by an extended node.
+const nodeSize = int(unsafe.Sizeof(Node{}))
+const nodeXSize = int(unsafe.Sizeof(nodeX{}))
+
+// Stats returns storage statistics of the tree,
+//
+//	"node.count"     : number of elements in the tree.
+//	"node.overhead"  : estimated bytes used by nodes, excluding items.
+//	"item.bytes"     : bytes held by items, as returned by Item.Size.
+//	"height.avg"     : average depth of elements.
+//	"height.stddev"  : standard deviation of depth of elements.
+//	"height.max"     : depth of the deepest element.
+//
+// Stats walks the whole tree, in O(n).
+func (t *LLRB) Stats() map[string]interface{} {
+	stats, _ := treeStats(t.root)
+	return stats
+}
+
+// Stats returns storage statistics of the tree, same as LLRB.Stats,
+// along with,
+//
+//	"snapshot.count" : number of unreleased snapshots, including
+//	                   snapshots of trees this tree was split
+//	                   from or joined from.
+//	"snapshot.nodes" : number of nodes held alive only by snapshots.
+//	"snapshot.bytes" : bytes held alive only by snapshots, both by
+//	                   nodes and by items removed from the tree
+//	                   while snapshots were held.
+//	"node.fresh"     : number of nodes allocated from slab or heap.
+//	"node.recycled"  : number of nodes allocated from recycled nodes.
+//	"node.tombstones": number of tombstones in the tree, they are
+//	                   not counted in "node.count".
+//	"snapshot.expired": number of snapshots expired by the writer.
+//
+// Snapshot stats are loaded from counters kept by the writer, Stats
+// doesn't change them. Called on a snapshot, Stats walks the
+// snapshot and reports snapshot stats of its writer, without node
+// stats, and can be called by any goroutine. Called on the writer,
+// Stats shall be called by the writer goroutine.
+func (t *LLRBMVCC) Stats() map[string]interface{} {
+	stats, ndead := treeStats(t.Root())
+	stats["node.tombstones"] = ndead
+	writer := t
+	if t.reader != nil {
+		writer = t.writer
+	}
+	nsnapshots, nodes, bytes := writer.heldStats()
+	stats["snapshot.count"] = nsnapshots
+	stats["snapshot.nodes"] = nodes
+	if writer.extended() {
+		stats["snapshot.bytes"] = bytes + nodes*nodeXSize
+	} else {
+		stats["snapshot.bytes"] = bytes + nodes*nodeSize
+	}
+	stats["snapshot.expired"] = atomic.LoadInt64(&writer.nexpired)
+	if t.pool != nil {
+		stats["node.fresh"] = t.pool.nfresh
+		stats["node.recycled"] = t.pool.nrecycled
+	}
+	return stats
+}
+
+// heldStats returns the number of unreleased snapshots, along with
+// the number of nodes and the bytes of items held for them. Nodes
+// of released snapshots are still held if an older snapshot is not
+// released, same as gc. Only loads counters, hence it can be called
+// concurrently with the writer.
+func (t *LLRBMVCC) heldStats() (nsnapshots, nodes, bytes int) {
+	unreleased := false
+	for _, r := range *(*[]*reclaimed)(atomic.LoadPointer(&t.held)) {
+		released := r.released()
+		if !released {
+			for _, e := range r.epochs {
+				nsnapshots += e.readers()
+			}
+		}
+		if unreleased = unreleased || !released; unreleased {
+			nodes += int(atomic.LoadInt64(&r.nnodes))
+			bytes += int(atomic.LoadInt64(&r.bytes))
+		}
+	}
+	// snapshots of the current epoch, not yet closed by the writer.
+	e := (*epoch)(atomic.LoadPointer(&t.epoch))
+	state := atomic.LoadUint64(&t.state)
+	if state>>epochShift == e.id {
+		n := int64(state&enteredMask) - int64(atomic.LoadUint64(&e.left))
+		nsnapshots += int(max(n, 0))
+	}
+	return nsnapshots, nodes, bytes
+}
+
+// treeStats returns stats of the tree rooted at root, along with
+// the number of tombstones, which are included in node overhead.
+func treeStats(root *Node) (map[string]interface{}, int) {
+	av, maxheight, ndead, overhead := &golib.Average{}, 0, 0, 0
+	walkTree(root, 0, func(h *Node, depth int) {
+		if h.Meta.dead {
+			ndead++
+		}
+		if overhead += nodeSize; h.Meta.ext {
+			overhead += nodeXSize - nodeSize
+		}
+		av.Add(float64(depth))
+		maxheight = max(maxheight, depth)
+	})
+	return map[string]interface{}{
+		"node.count":    countOf(root),
+		"node.overhead": overhead,
+		"item.bytes":    sizeOf(root),
+		"height.avg":    av.GetAvg(),
+		"height.stddev": av.GetStdDev(),
+		"height.max":    maxheight,
+	}, ndead
+}
+
+// walkTree calls fn for every node in the sub-tree rooted at h,
+// along with its depth.
+func walkTree(h *Node, depth int, fn func(h *Node, depth int)) {
+	if h == nil {
+		return
+	}
+	walkTree(h.Left, depth+1, fn)
+	fn(h, depth)
+	walkTree(h.Right, depth+1, fn)
+}
@@ -0,0 +1,157 @@
+package llrb
+
+import "sync/atomic"
+
+// tombstones and sequence numbers for LLRBMVCC. Every mutation on
+// the writer gets a monotonically increasing sequence number. If
+// tombstones are enabled, every node is stamped with the seqno of
+// the mutation that last set its element, kept in the extension of
+// the node, and deleted elements are only marked as dead and
+// stamped, so that snapshot diffs see them
+// as deletes, and are physically removed later by Purge. Tombstones
+// are not counted in the sub-tree count, size, interval-end and
+// aggregate of nodes, lookups and iterations skip them.
+
+// SetTombstones enables, or disables, tombstones for deleted
+// elements. Duplicates are not allowed with tombstones, and trees
+// with tombstones cannot be split or joined. Shall be called before
+// populating the tree.
+func (t *LLRBMVCC) SetTombstones(allow bool) {
+	if allow && t.dups {
+		panic("tombstones are not allowed with duplicates")
+	}
+	t.tombs = allow
+}
+
+// Tombstones returns true if deleted elements are left in the tree
+// as tombstones.
+func (t *LLRBMVCC) Tombstones() bool {
+	return t.tombs
+}
+
+// Seqno returns the sequence number of the latest mutation on the
+// tree. For a snapshot, all mutations upto Seqno are seen by it, a
+// mutation published while the snapshot was being acquired might
+// be seen as well.
+func (t *LLRBMVCC) Seqno() uint64 {
+	return atomic.LoadUint64(&t.seqno)
+}
+
+// Purge physically removes tombstones set by mutations upto seqno
+// that are older than every live snapshot of the tree. Returns the
+// number of tombstones removed. Purge walks the whole tree, in
+// O(n), and shall be called by the writer.
+func (t *LLRBMVCC) Purge(seqno uint64) int {
+	if t.reader != nil {
+		panic("cannot purge a snapshot")
+	}
+	for _, snapshot := range t.pending() {
+		seqno = min(seqno, snapshot.seqno)
+	}
+	return t.purge(seqno)
+}
+
+// purge removes tombstones set by mutations upto seqno, whether or
+// not they are older than live snapshots. Tombstones are removed
+// from a private version of the tree, same as a Batch, which is
+// published once.
+func (t *LLRBMVCC) purge(seqno uint64) int {
+	keys := make([]Item, 0)
+	walkTree(t.Root(), 0, func(h *Node, _ int) {
+		if h.Meta.dead && extOf(h).seqno <= seqno {
+			keys = append(keys, h.Item)
+		}
+	})
+	if len(keys) == 0 {
+		return 0
+	}
+	t.begin()
+	defer t.discard(t.count, t.written)
+	for _, key := range keys {
+		root, removed := t.algo.Delete(t.tip(), key)
+		if root != nil {
+			root.Black = true
+		}
+		t.reclaim = append(t.reclaim, removed)
+		t.drop(removed.Item)
+		t.publish("purge", root)
+	}
+	t.apply("purge")
+	return len(keys)
+}
+
+// stamp marks h as set by the latest mutation, seqno of nodes is
+// needed only with tombstones.
+func (t *LLRBMVCC) stamp(h *Node) *Node {
+	if t.tombs {
+		extOf(h).seqno = t.written
+	}
+	return h
+}
+
+// killKey marks the live element of same order as key as a
+// tombstone, and returns the same.
+func (t *LLRBMVCC) killKey(opname string, key Item) Item {
+	t.written++
+	root, deleted := t.kill(t.tip(), key)
+	if deleted == nil {
+		return nil
+	}
+	t.publish(opname, root)
+	t.count--
+	return deleted
+}
+
+// kill copies the path to the element of same order as key, only if
+// the element is live, tree structure is left untouched.
+func (t *LLRBMVCC) kill(h *Node, key Item) (*Node, Item) {
+	if h == nil {
+		return nil, nil
+	}
+
+	var deleted Item
+	var child *Node
+	hnew := h
+	if key.Less(h.Item) {
+		if child, deleted = t.kill(h.Left, key); deleted != nil {
+			hnew = t.own(h)
+			hnew.Left = child
+		}
+	} else if h.Item.Less(key) {
+		if child, deleted = t.kill(h.Right, key); deleted != nil {
+			hnew = t.own(h)
+			hnew.Right = child
+		}
+	} else if !h.Meta.dead {
+		deleted, hnew = h.Item, t.stamp(t.own(h))
+		hnew.Meta.dead = true
+	}
+	if deleted == nil {
+		return h, nil
+	}
+
+	t.algo.Update(hnew)
+	return hnew, deleted
+}
+
+// floorLive is same as floorOf, skipping tombstones.
+func floorLive(h *Node, key Item, equal bool) Item {
+	cur := newCursor(h)
+	if cur.Seek(key); !cur.Valid() {
+		cur.Last()
+	} else if equal && !key.Less(cur.Item()) {
+		return cur.Item()
+	} else {
+		cur.Prev()
+	}
+	return cur.Item()
+}
+
+// ceilingLive is same as ceilingOf, skipping tombstones.
+func ceilingLive(h *Node, key Item, equal bool) Item {
+	cur := newCursor(h)
+	if cur.Seek(key); cur.Valid() && !equal && !key.Less(cur.Item()) {
+		cur.Next()
+	}
+	return cur.Item()
+}
@@ -0,0 +1,252 @@
+// Package typed implements type-safe Left-Leaning Red-Black
+// (LLRB) trees, that are parametrized on the type of key and
+// value and ordered using a comparator function. Unlike the
+// Item based trees in package llrb, keys of different types
+// cannot be mixed and lookups don't allocate. Both share the
+// LLRB algorithm implemented by package llrb/internal/core.
+package typed
+
+import "github.com/prataprc/golib/llrb/internal/core"
+
+// Compare shall return a negative number if a is less than b,
+// zero if a and b are of same order and a positive number if a
+// is greater than b.
+type Compare[K any] func(a, b K) int
+
+// CompareItems is a comparator for llrb.Item, so that existing
+// key types can be used with type-safe trees.
+func CompareItems[K interface{ Less(K) bool }](a, b K) int {
+	if a.Less(b) {
+		return -1
+	} else if b.Less(a) {
+		return 1
+	}
+	return 0
+}
+
+// LLRB is a type-safe Left-Leaning Red-Black (LLRB)
+// implementation of 2-3 trees.
+type LLRB[K, V any] struct {
+	algo  core.Algo[K, V]
+	root  *core.Node[K, V]
+	count int
+}
+
+// NewLLRB allocates a new tree, keys are ordered using cmp.
+func NewLLRB[K, V any](cmp Compare[K]) *LLRB[K, V] {
+	return &LLRB[K, V]{algo: core.Algo[K, V]{Compare: cmp}}
+}
+
+// Len returns the number of entries in the tree.
+func (t *LLRB[K, V]) Len() int {
+	return t.count
+}
+
+// Has returns true if the tree contains key.
+func (t *LLRB[K, V]) Has(key K) bool {
+	return t.algo.Get(t.root, key) != nil
+}
+
+// Get returns the value for key.
+func (t *LLRB[K, V]) Get(key K) (value V, ok bool) {
+	return get(&t.algo, t.root, key)
+}
+
+// Min returns the entry with minimum key.
+func (t *LLRB[K, V]) Min() (key K, value V, ok bool) {
+	return minOf(t.root)
+}
+
+// Max returns the entry with maximum key.
+func (t *LLRB[K, V]) Max() (key K, value V, ok bool) {
+	return maxOf(t.root)
+}
+
+// Upsert sets value for key. If key is already present, its
+// old value is replaced and returned.
+func (t *LLRB[K, V]) Upsert(key K, value V) (old V, ok bool) {
+	var replaced *core.Node[K, V]
+	n := &core.Node[K, V]{Item: key, Meta: value}
+	t.root, replaced = t.algo.Upsert(t.root, n)
+	t.root.Black = true
+	if replaced == nil {
+		t.count++
+		return old, false
+	}
+	return replaced.Meta, true
+}
+
+// DeleteMin deletes the entry with minimum key and returns
+// the same.
+func (t *LLRB[K, V]) DeleteMin() (key K, value V, ok bool) {
+	var deleted *core.Node[K, V]
+	t.root, deleted = t.algo.DeleteMin(t.root)
+	return t.removed(deleted)
+}
+
+// DeleteMax deletes the entry with maximum key and returns
+// the same.
+func (t *LLRB[K, V]) DeleteMax() (key K, value V, ok bool) {
+	var deleted *core.Node[K, V]
+	t.root, deleted = t.algo.DeleteMax(t.root)
+	return t.removed(deleted)
+}
+
+// Delete deletes key from the tree and returns its value.
+func (t *LLRB[K, V]) Delete(key K) (value V, ok bool) {
+	var deleted *core.Node[K, V]
+	t.root, deleted = t.algo.Delete(t.root, key)
+	_, value, ok = t.removed(deleted)
+	return value, ok
+}
+
+// removed accounts for node h, removed from the tree, and returns
+// its entry.
+func (t *LLRB[K, V]) removed(h *core.Node[K, V]) (key K, value V, ok bool) {
+	if t.root != nil {
+		t.root.Black = true
+	}
+	if h == nil {
+		return key, value, false
+	}
+	t.count--
+	return h.Item, h.Meta, true
+}
+
+// Range iterates entries between low and high in ascending
+// order, nil low or high is unbounded. incl is,
+//
+//	"low"  : iterate including low-key, excluding high-key
+//	"high" : iterate including high-key, excluding low-key
+//	"both" : iterate including both low-key and high-key
+//	"none" : iterate excluding both low-key and high-key
+func (t *LLRB[K, V]) Range(low, high *K, incl string, iter func(K, V) bool) {
+	b := newBounds[K, V](t.algo.Compare, low, high, incl)
+	b.ascend(t.root, iter)
+}
+
+// ReverseRange is same as Range, but iterates entries in
+// descending order.
+func (t *LLRB[K, V]) ReverseRange(
+	low, high *K, incl string, iter func(K, V) bool) {
+
+	b := newBounds[K, V](t.algo.Compare, low, high, incl)
+	b.descend(t.root, iter)
+}
+
+//-----
+// node
+//-----
+
+// nodes of type-safe trees hold the value of their key in Meta.
+
+func minOf[K, V any](h *core.Node[K, V]) (key K, value V, ok bool) {
+	if h == nil {
+		return key, value, false
+	}
+	for h.Left != nil {
+		h = h.Left
+	}
+	return h.Item, h.Meta, true
+}
+
+func maxOf[K, V any](h *core.Node[K, V]) (key K, value V, ok bool) {
+	if h == nil {
+		return key, value, false
+	}
+	for h.Right != nil {
+		h = h.Right
+	}
+	return h.Item, h.Meta, true
+}
+
+// get returns the value for key, from the sub-tree rooted at h.
+func get[K, V any](
+	a *core.Algo[K, V], h *core.Node[K, V], key K) (value V, ok bool) {
+
+	if h = a.Get(h, key); h == nil {
+		return value, false
+	}
+	return h.Meta, true
+}
+
+//------
+// range
+//------
+
+type bounds[K, V any] struct {
+	cmp        func(a, b K) int
+	low, high  *K
+	linc, hinc bool
+}
+
+func newBounds[K, V any](
+	cmp func(a, b K) int, low, high *K, incl string) bounds[K, V] {
+
+	b := bounds[K, V]{cmp: cmp, low: low, high: high}
+	switch incl {
+	case "both":
+		b.linc, b.hinc = true, true
+	case "low":
+		b.linc = true
+	case "high":
+		b.hinc = true
+	}
+	return b
+}
+
+// aboveLow returns true if key is within the low bound.
+func (b *bounds[K, V]) aboveLow(key K) bool {
+	if b.low == nil {
+		return true
+	}
+	c := b.cmp(key, *b.low)
+	return c > 0 || (c == 0 && b.linc)
+}
+
+// belowHigh returns true if key is within the high bound.
+func (b *bounds[K, V]) belowHigh(key K) bool {
+	if b.high == nil {
+		return true
+	}
+	c := b.cmp(key, *b.high)
+	return c < 0 || (c == 0 && b.hinc)
+}
+
+func (b *bounds[K, V]) ascend(h *core.Node[K, V], iter func(K, V) bool) bool {
+	if h == nil {
+		return true
+	}
+	if !b.belowHigh(h.Item) {
+		return b.ascend(h.Left, iter)
+	}
+	if !b.aboveLow(h.Item) {
+		return b.ascend(h.Right, iter)
+	}
+	if !b.ascend(h.Left, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item, h.Meta) {
+		return false
+	}
+	return b.ascend(h.Right, iter)
+}
+
+func (b *bounds[K, V]) descend(h *core.Node[K, V], iter func(K, V) bool) bool {
+	if h == nil {
+		return true
+	}
+	if !b.belowHigh(h.Item) {
+		return b.descend(h.Left, iter)
+	}
+	if !b.aboveLow(h.Item) {
+		return b.descend(h.Right, iter)
+	}
+	if !b.descend(h.Right, iter) {
+		return false
+	}
+	if iter != nil && !iter(h.Item, h.Meta) {
+		return false
+	}
+	return b.descend(h.Left, iter)
+}
@@ -0,0 +1,168 @@
+package typed
+
+import "sync/atomic"
+
+import "github.com/prataprc/golib/llrb/internal/core"
+
+// LLRBMVCC is a type-safe Left-Leaning Red-Black (LLRB)
+// implementation of 2-3 trees supporting concurrent reads.
+// Writes are copy-on-write, so that snapshots taken by readers
+// are not disturbed by future writes. Nodes copied by a write
+// are garbage collected once no snapshot refers to them. Nodes
+// copied, or allocated, by a write are owned by it until the write
+// is published, and are modified in place instead of being copied
+// again.
+type LLRBMVCC[K, V any] struct {
+	algo   core.Algo[K, V]
+	root   atomic.Pointer[core.Node[K, V]]
+	count  int
+	reader bool
+	owned  map[*core.Node[K, V]]bool // nodes of the write in progress
+}
+
+// NewLLRBMVCC allocates a new tree, keys are ordered using cmp.
+func NewLLRBMVCC[K, V any](cmp Compare[K]) *LLRBMVCC[K, V] {
+	t := &LLRBMVCC[K, V]{owned: make(map[*core.Node[K, V]]bool)}
+	t.algo = core.Algo[K, V]{Compare: cmp, Copy: t.own}
+	return t
+}
+
+// Len returns the number of entries in the tree.
+func (t *LLRBMVCC[K, V]) Len() int {
+	return t.count
+}
+
+// Has returns true if the tree contains key.
+func (t *LLRBMVCC[K, V]) Has(key K) bool {
+	return t.algo.Get(t.root.Load(), key) != nil
+}
+
+// Get returns the value for key.
+func (t *LLRBMVCC[K, V]) Get(key K) (value V, ok bool) {
+	return get(&t.algo, t.root.Load(), key)
+}
+
+// Min returns the entry with minimum key.
+func (t *LLRBMVCC[K, V]) Min() (key K, value V, ok bool) {
+	return minOf(t.root.Load())
+}
+
+// Max returns the entry with maximum key.
+func (t *LLRBMVCC[K, V]) Max() (key K, value V, ok bool) {
+	return maxOf(t.root.Load())
+}
+
+// Upsert sets value for key. If key is already present, its
+// old value is replaced and returned.
+func (t *LLRBMVCC[K, V]) Upsert(key K, value V) (old V, ok bool) {
+	t.mustWriter()
+	n := &core.Node[K, V]{Item: key, Meta: value}
+	t.owned[n] = true
+	root, replaced := t.algo.Upsert(t.root.Load(), n)
+	root.Black = true
+	t.publish(root)
+	if replaced == nil {
+		t.count++
+		return old, false
+	}
+	return replaced.Meta, true
+}
+
+// DeleteMin deletes the entry with minimum key and returns
+// the same.
+func (t *LLRBMVCC[K, V]) DeleteMin() (key K, value V, ok bool) {
+	t.mustWriter()
+	return t.setRoot(t.algo.DeleteMin(t.root.Load()))
+}
+
+// DeleteMax deletes the entry with maximum key and returns
+// the same.
+func (t *LLRBMVCC[K, V]) DeleteMax() (key K, value V, ok bool) {
+	t.mustWriter()
+	return t.setRoot(t.algo.DeleteMax(t.root.Load()))
+}
+
+// Delete deletes key from the tree and returns its value.
+func (t *LLRBMVCC[K, V]) Delete(key K) (value V, ok bool) {
+	t.mustWriter()
+	_, value, ok = t.setRoot(t.algo.Delete(t.root.Load(), key))
+	return value, ok
+}
+
+// setRoot publishes root, after node h is removed from the tree,
+// and returns the entry of h.
+func (t *LLRBMVCC[K, V]) setRoot(
+	root, h *core.Node[K, V]) (key K, value V, ok bool) {
+
+	if root != nil {
+		root.Black = true
+	}
+	t.publish(root)
+	if h == nil {
+		return key, value, false
+	}
+	t.count--
+	return h.Item, h.Meta, true
+}
+
+// Range iterates entries between low and high in ascending
+// order, refer to LLRB.Range for details.
+func (t *LLRBMVCC[K, V]) Range(
+	low, high *K, incl string, iter func(K, V) bool) {
+
+	b := newBounds[K, V](t.algo.Compare, low, high, incl)
+	b.ascend(t.root.Load(), iter)
+}
+
+// ReverseRange is same as Range, but iterates entries in
+// descending order.
+func (t *LLRBMVCC[K, V]) ReverseRange(
+	low, high *K, incl string, iter func(K, V) bool) {
+
+	b := newBounds[K, V](t.algo.Compare, low, high, incl)
+	b.descend(t.root.Load(), iter)
+}
+
+// RSnapshot shall be called on the writer and returns a
+// read-only snapshot of the tree, that won't be disturbed by
+// future writes. Writing into a snapshot will panic.
+func (t *LLRBMVCC[K, V]) RSnapshot() *LLRBMVCC[K, V] {
+	t.mustWriter()
+	snapshot := &LLRBMVCC[K, V]{algo: t.algo, count: t.count, reader: true}
+	snapshot.root.Store(t.root.Load())
+	return snapshot
+}
+
+// ReleaseSnapshot releases the snapshot, the snapshot shall not
+// be used after this call.
+func (t *LLRBMVCC[K, V]) ReleaseSnapshot() {
+	if !t.reader {
+		panic("cannot release writer")
+	}
+	t.root.Store(nil)
+	t.count = 0
+}
+
+func (t *LLRBMVCC[K, V]) mustWriter() {
+	if t.reader {
+		panic("cannot write into snapshot")
+	}
+}
+
+// publish root, nodes owned by the write become shared with
+// snapshots taken hereafter.
+func (t *LLRBMVCC[K, V]) publish(root *core.Node[K, V]) {
+	t.root.Store(root)
+	clear(t.owned)
+}
+
+// own copies h before it is modified, unless h is owned by the
+// write in progress.
+func (t *LLRBMVCC[K, V]) own(h *core.Node[K, V]) *core.Node[K, V] {
+	if t.owned[h] {
+		return h
+	}
+	hnew := *h
+	t.owned[&hnew] = true
+	return &hnew
+}
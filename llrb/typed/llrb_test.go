@@ -0,0 +1,200 @@
+package typed
+
+import (
+	"cmp"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/prataprc/golib/llrb"
+	"github.com/prataprc/golib/llrb/internal/core"
+)
+
+func TestLLRB(t *testing.T) {
+	tree, ref := NewLLRB[int, string](cmp.Compare[int]), map[int]string{}
+	testTree(t, tree, ref)
+	if n := validate(t, tree.root); n != tree.Len() || n != len(ref) {
+		t.Fatalf("expected %v, got %v", len(ref), n)
+	}
+}
+
+func TestLLRBMVCC(t *testing.T) {
+	tree, ref := NewLLRBMVCC[int, string](cmp.Compare[int]), map[int]string{}
+	for i := 0; i < 100; i++ {
+		tree.Upsert(i, "snap")
+		ref[i] = "snap"
+	}
+	snapshot := tree.RSnapshot()
+	testTree(t, tree, ref)
+	if n := validate(t, tree.root.Load()); n != tree.Len() || n != len(ref) {
+		t.Fatalf("expected %v, got %v", len(ref), n)
+	}
+	// snapshot is not disturbed by writes.
+	if validate(t, snapshot.root.Load()) != 100 || snapshot.Len() != 100 {
+		t.Fatalf("expected 100 entries in snapshot")
+	}
+	count := 0
+	snapshot.Range(nil, nil, "both", func(k int, v string) bool {
+		if k != count || v != "snap" {
+			t.Fatalf("unexpected {%v %v} in snapshot", k, v)
+		}
+		count++
+		return true
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic writing into snapshot")
+			}
+		}()
+		snapshot.Upsert(1, "")
+	}()
+	snapshot.ReleaseSnapshot()
+
+	// a write copies a node atmost once, copies are modified in
+	// place by the same write.
+	copied, own := map[*core.Node[int, string]]bool{}, tree.algo.Copy
+	tree.algo.Copy = func(h *core.Node[int, string]) *core.Node[int, string] {
+		hnew := own(h)
+		if hnew != h && copied[h] {
+			t.Fatalf("node %v copied again by the same write", h.Item)
+		} else if hnew != h {
+			copied[hnew] = true
+		}
+		return hnew
+	}
+	for _, i := range rand.Perm(1000) {
+		if i%3 == 0 {
+			tree.Delete(i % 200)
+		} else {
+			tree.Upsert(i, "")
+		}
+		clear(copied)
+	}
+	validate(t, tree.root.Load())
+}
+
+func TestCompareItems(t *testing.T) {
+	tree := NewLLRB[llrb.Item, int](CompareItems[llrb.Item])
+	for _, i := range rand.Perm(100) {
+		tree.Upsert(&llrb.KeyInt{Key: int64(i)}, i)
+	}
+	low, high := llrb.Item(&llrb.KeyInt{Key: 10}), llrb.Item(&llrb.KeyInt{Key: 20})
+	keys := []int{}
+	tree.ReverseRange(&low, &high, "high", func(k llrb.Item, v int) bool {
+		keys = append(keys, v)
+		return true
+	})
+	if len(keys) != 10 || keys[0] != 20 || keys[9] != 11 {
+		t.Fatalf("unexpected %v", keys)
+	}
+}
+
+type tree interface {
+	Len() int
+	Has(key int) bool
+	Get(key int) (string, bool)
+	Min() (int, string, bool)
+	Max() (int, string, bool)
+	Upsert(key int, value string) (string, bool)
+	DeleteMin() (int, string, bool)
+	DeleteMax() (int, string, bool)
+	Delete(key int) (string, bool)
+	Range(low, high *int, incl string, iter func(int, string) bool)
+	ReverseRange(low, high *int, incl string, iter func(int, string) bool)
+}
+
+func testTree(t *testing.T, tree tree, ref map[int]string) {
+	n := 1000
+	for i := 0; i < 10*n; i++ {
+		key, value := rand.Intn(n), string(rune('a'+rand.Intn(26)))
+		switch rand.Intn(7) {
+		case 0, 1, 2, 3:
+			old, ok := tree.Upsert(key, value)
+			refold, refok := ref[key]
+			if ok != refok || old != refold {
+				t.Fatalf("expected %v %v, got %v %v", refold, refok, old, ok)
+			}
+			ref[key] = value
+		case 4:
+			old, ok := tree.Delete(key)
+			refold, refok := ref[key]
+			if ok != refok || old != refold {
+				t.Fatalf("expected %v %v, got %v %v", refold, refok, old, ok)
+			}
+			delete(ref, key)
+		case 5:
+			k, v, ok := tree.Min()
+			if k1, v1, ok1 := tree.DeleteMin(); k1 != k || v1 != v || ok1 != ok {
+				t.Fatalf("expected %v %v, got %v %v", k, v, k1, v1)
+			}
+			delete(ref, k)
+		case 6:
+			k, v, ok := tree.Max()
+			if k1, v1, ok1 := tree.DeleteMax(); k1 != k || v1 != v || ok1 != ok {
+				t.Fatalf("expected %v %v, got %v %v", k, v, k1, v1)
+			}
+			delete(ref, k)
+		}
+		if tree.Len() != len(ref) {
+			t.Fatalf("expected %v, got %v", len(ref), tree.Len())
+		}
+	}
+	keys := []int{}
+	for key, value := range ref {
+		if v, ok := tree.Get(key); !ok || v != value || !tree.Has(key) {
+			t.Fatalf("expected %v for %v, got %v", value, key, v)
+		}
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	low, high := keys[10], keys[len(keys)-10]
+	i := 10
+	tree.Range(&low, &high, "low", func(k int, v string) bool {
+		if k != keys[i] || v != ref[k] {
+			t.Fatalf("expected %v, got %v", keys[i], k)
+		}
+		i++
+		return true
+	})
+	if i != len(keys)-10 {
+		t.Fatalf("expected %v, got %v", len(keys)-10, i)
+	}
+	i = len(keys)
+	tree.ReverseRange(&low, nil, "none", func(k int, v string) bool {
+		i--
+		if k != keys[i] {
+			t.Fatalf("expected %v, got %v", keys[i], k)
+		}
+		return true
+	})
+	if i != 11 {
+		t.Fatalf("expected 11, got %v", i)
+	}
+}
+
+func validate[K, V any](t *testing.T, h *core.Node[K, V]) int {
+	if core.IsRed(h) {
+		t.Fatalf("root must be black")
+	}
+	var walk func(h *core.Node[K, V]) (count, blacks int)
+	walk = func(h *core.Node[K, V]) (int, int) {
+		if h == nil {
+			return 0, 1
+		}
+		if core.IsRed(h.Right) || (core.IsRed(h) && core.IsRed(h.Left)) {
+			t.Fatalf("invalid red link at %v", h.Item)
+		}
+		lcount, lblacks := walk(h.Left)
+		rcount, rblacks := walk(h.Right)
+		if lblacks != rblacks {
+			t.Fatalf("unbalanced black height at %v", h.Item)
+		}
+		if h.Black {
+			lblacks++
+		}
+		return lcount + rcount + 1, lblacks
+	}
+	count, _ := walk(h)
+	return count
+}
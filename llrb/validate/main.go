@@ -231,6 +231,18 @@ func validate(
 	case "max":
 		ref = d.Max()
 		val = rb.Max()
+	case "floor":
+		ref = d.Floor(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+		val = rb.Floor(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+	case "ceiling":
+		ref = d.Ceiling(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+		val = rb.Ceiling(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+	case "lower":
+		ref = d.Lower(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+		val = rb.Lower(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+	case "higher":
+		ref = d.Higher(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+		val = rb.Higher(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
 	case "delmin":
 		ref = d.DeleteMin()
 		val = rb.DeleteMin()
@@ -245,17 +257,20 @@ func validate(
 	case "insert":
 		now := time.Now().UnixNano()
 		k := &llrb.KeyInt{int64(cmd[1].(float64)), now}
-		if rb.Get(k) == nil {
-			d.Insert(k)
-			rb.Insert(k)
-		} else {
-			cmd[0] = "upsert"
-			ref = d.Upsert(k)
-			val = rb.Upsert(k)
-		}
+		// trees are validated without duplicates, where Insert
+		// shall replace an existing key.
+		d.Insert(k)
+		rb.Insert(k)
 	case "delete":
 		ref = d.Delete(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
 		val = rb.Delete(&llrb.KeyInt{int64(cmd[1].(float64)), -1})
+	case "delrange":
+		low := int64(cmd[1].(float64))
+		high := low + int64(cmd[2].(float64))
+		lkey, hkey := &llrb.KeyInt{low, -1}, &llrb.KeyInt{high, -1}
+		incl := cmd[3].(string)
+		ref = d.DeleteRange(lkey, hkey, incl)
+		val = rb.DeleteRange(lkey, hkey, incl)
 	default:
 		log.Fatalf("unknown command %v\n", cmd)
 		return stats
@@ -282,6 +297,19 @@ func validateEqual(d *llrb.Dict, rb llrb.MemStore) {
 	if reflect.DeepEqual(refKeys, keys) == false {
 		log.Fatalf("final Dict keys and LLRB keys mismatch\n")
 	}
+
+	refKeys, keys = refKeys[:0], keys[:0]
+	rb.ReverseRange(nil, nil, "both", func(k llrb.Item) bool {
+		refKeys = append(refKeys, k.(*llrb.KeyInt))
+		return true
+	})
+	d.ReverseRange(nil, nil, "both", func(k llrb.Item) bool {
+		keys = append(keys, k.(*llrb.KeyInt))
+		return true
+	})
+	if reflect.DeepEqual(refKeys, keys) == false {
+		log.Fatalf("final Dict keys and LLRB keys mismatch in reverse\n")
+	}
 }
 
 //--------
@@ -312,11 +340,12 @@ func printStats(stats map[string]int) {
 }
 
 var writeOps = map[string]bool{
-	"delmin": true,
-	"delmax": true,
-	"upsert": true,
-	"insert": true,
-	"delete": true,
+	"delmin":   true,
+	"delmax":   true,
+	"upsert":   true,
+	"insert":   true,
+	"delete":   true,
+	"delrange": true,
 }
 
 func isReadOp(cmd []interface{}) bool {
@@ -0,0 +1,644 @@
+package llrb
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "math/bits"
+import "os"
+import "path/filepath"
+import "reflect"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Write-ahead log for LLRBMVCC. Every record is framed as,
+//
+//	payload-len uint32 | crc32-castagnoli of payload uint32 | payload
+//
+// and payload is,
+//
+//	op byte | encoded-item
+//
+// When a record carries more than one item, all but the last item
+// are prefixed with their length as uint32. Swap records carry the
+// old item followed by the new item, and delete-range records are,
+//
+//	op byte | incl byte | bounds byte | [low-item] | [high-item]
+//
+// where bit 0 and bit 1 of bounds are set if low-item and
+// high-item, respectively, are present. Batch records carry all
+// writes of a committed batch, so that it is recovered as a whole,
+//
+//	op byte | count uint32 | count op bytes | items
+//
+// where each op is an upsert, insert, delete, delete-min or
+// delete-max, and items are the keys of upsert, insert and delete
+// ops, in order.
+// A record that is short, or fails the checksum, is the end of the
+// log, left by a torn write from a crash, and is truncated during
+// recovery. If a valid record follows an invalid record the log is
+// corrupt and fails the recovery.
+//
+// Checkpoint dumps are numbered, and every log starts with a
+// checkpoint record carrying the number of the dump it follows,
+// zero if it follows no dump,
+//
+//	op byte | checkpoint uint64
+//
+// a log is attached only to a tree at the same checkpoint, and a
+// log that does not start with a checkpoint record fails the
+// recovery. During recovery, a log that follows an older dump than
+// the one loaded is already covered by the dump and is discarded,
+// since replaying writes that are not idempotent would corrupt the
+// tree.
+
+const (
+	walCodec       byte = iota + 1 // payload is the codec name
+	walUpsert                      // Upsert(item)
+	walInsert                      // Insert(item)
+	walDelete                      // Delete(item)
+	walDeleteMin                   // DeleteMin()
+	walDeleteMax                   // DeleteMax()
+	walDeleteItem                  // DeleteDuplicate, matching encoded item
+	walSwap                        // CompareAndSwap on duplicates
+	walDeleteRange                 // DeleteRange(low, high, incl)
+	walBatch                       // Batch.Commit()
+	walCheckpoint                  // log follows checkpoint dump
+)
+
+// WAL is an append-only log of mutations applied on a LLRBMVCC
+// tree. WAL is not thread safe and shall be used only by the
+// writer. Write errors are sticky, refer Err().
+type WAL struct {
+	fd    *os.File
+	w     *bufio.Writer
+	codec Codec
+	err   error
+	buf   []byte
+	size  int64 // bytes in the log
+	// checkpoint the log follows, if it starts with a checkpoint
+	// record.
+	follows  uint64
+	followed bool
+	// fsync batching
+	syncevery int
+	pending   int
+	dirty     int32 // records written and not fsync-ed, atomic
+	mu        sync.Mutex
+	syncerr   error // from the background fsync
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// OpenWAL opens the log file at path for appending, creating it
+// if it does not exist. Every record is written to the log file as
+// it is appended, and the log is fsync-ed after every syncevery
+// records. If syncinterval is greater than zero, records not yet
+// fsync-ed are fsync-ed in the background every syncinterval. If
+// syncevery is less than 2 every record is fsync-ed.
+func OpenWAL(path string, syncevery int, syncinterval time.Duration) (*WAL, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	fd, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal := &WAL{
+		fd:        fd,
+		w:         bufio.NewWriterSize(fd, 64*1024),
+		buf:       make([]byte, 0, 256),
+		syncevery: syncevery,
+	}
+	if err := wal.head(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if syncinterval > 0 {
+		wal.stop, wal.done = make(chan struct{}), make(chan struct{})
+		go wal.syncer(syncinterval)
+	}
+	return wal, nil
+}
+
+// head reads the checkpoint record that the log starts with.
+func (wal *WAL) head() error {
+	info, err := wal.fd.Stat()
+	if err != nil {
+		return err
+	} else if wal.size = info.Size(); wal.size == 0 {
+		return nil
+	}
+	var frame [8 + 1 + 8]byte
+	if _, err := wal.fd.ReadAt(frame[:], 0); err != nil && err != io.EOF {
+		return err
+	}
+	payload := frame[8:]
+	if binary.BigEndian.Uint32(frame[:]) == uint32(len(payload)) &&
+		binary.BigEndian.Uint32(frame[4:]) == crc32.Checksum(payload, crcTable) &&
+		payload[0] == walCheckpoint {
+
+		wal.follows, wal.followed = binary.BigEndian.Uint64(payload[1:]), true
+	}
+	return nil
+}
+
+// syncer fsyncs records written since the previous fsync, every
+// interval, until the log is closed.
+func (wal *WAL) syncer(interval time.Duration) {
+	defer close(wal.done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if !atomic.CompareAndSwapInt32(&wal.dirty, 1, 0) {
+				continue
+			} else if err := wal.fd.Sync(); err != nil {
+				wal.mu.Lock()
+				wal.syncerr = err
+				wal.mu.Unlock()
+				return
+			}
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// SetWAL attaches a write-ahead log to the writer, all subsequent
+// mutations are appended to the log. An empty log is started with
+// the tree's checkpoint, and a log that does not follow the tree's
+// checkpoint fails with a sticky error. Pass nil to detach.
+func (t *LLRBMVCC) SetWAL(wal *WAL) {
+	if t.reader != nil {
+		panic("cannot attach wal to a snapshot")
+	} else if wal != nil {
+		wal.follow(t.checkpoint)
+	}
+	t.wal = wal
+}
+
+func (t *LLRBMVCC) logWrite(op byte, items ...Item) {
+	if t.wal != nil {
+		t.wal.append(op, items...)
+	}
+}
+
+func (t *LLRBMVCC) logBatch(ops []byte, items []Item) {
+	if t.wal != nil {
+		t.wal.appendBatch(ops, items)
+	}
+}
+
+func (t *LLRBMVCC) logRange(op byte, low, high Item, incl string) {
+	if t.wal != nil {
+		t.wal.appendRange(op, low, high, incl)
+	}
+}
+
+var walIncls = []string{"none", "low", "high", "both"}
+
+// Err returns the first error encountered while writing the log,
+// log is not written once an error is encountered.
+func (wal *WAL) Err() error {
+	if wal.err == nil {
+		wal.mu.Lock()
+		wal.err = wal.syncerr
+		wal.mu.Unlock()
+	}
+	return wal.err
+}
+
+// Sync flushes buffered records and fsync the log file.
+func (wal *WAL) Sync() error {
+	if wal.Err() != nil {
+		return wal.err
+	}
+	atomic.StoreInt32(&wal.dirty, 0)
+	if wal.err = wal.w.Flush(); wal.err == nil {
+		wal.err = wal.fd.Sync()
+	}
+	wal.pending = 0
+	return wal.err
+}
+
+// Truncate discards all records in the log, shall be called after
+// the tree is durably checkpointed.
+func (wal *WAL) Truncate() error {
+	if err := wal.Sync(); err != nil {
+		return err
+	}
+	if wal.err = wal.fd.Truncate(0); wal.err == nil {
+		wal.err = wal.fd.Sync()
+	}
+	wal.codec, wal.size, wal.followed = nil, 0, false
+	return wal.err
+}
+
+// restart truncates the log, which then follows checkpoint dump.
+func (wal *WAL) restart(checkpoint uint64) error {
+	if err := wal.Truncate(); err != nil {
+		return err
+	}
+	wal.follow(checkpoint)
+	return wal.Sync()
+}
+
+// follow logs the checkpoint dump followed by the log, if the log
+// is empty, else the log shall follow the same checkpoint dump.
+func (wal *WAL) follow(checkpoint uint64) {
+	if wal.Err() != nil {
+		return
+	} else if wal.size > 0 {
+		if !wal.followed || wal.follows != checkpoint {
+			wal.err = fmt.Errorf("llrb: log does not follow checkpoint %v", checkpoint)
+		}
+		return
+	}
+	payload := append(wal.buf[:0], walCheckpoint)
+	wal.write(binary.BigEndian.AppendUint64(payload, checkpoint))
+	if wal.err == nil {
+		wal.err = wal.w.Flush()
+	}
+	wal.follows, wal.followed = checkpoint, true
+}
+
+// Close syncs and closes the log file.
+func (wal *WAL) Close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+		wal.stop = nil
+	}
+	err := wal.Sync()
+	if cerr := wal.fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (wal *WAL) append(op byte, items ...Item) {
+	if len(items) > 0 && !wal.setCodec(items[0]) {
+		return
+	}
+	wal.commit(wal.encode(append(wal.buf[:0], op), items))
+}
+
+func (wal *WAL) appendRange(op byte, low, high Item, incl string) {
+	bounds, items := byte(0), make([]Item, 0, 2)
+	if low != nil {
+		bounds, items = bounds|0x1, append(items, low)
+	}
+	if high != nil {
+		bounds, items = bounds|0x2, append(items, high)
+	}
+	if len(items) > 0 && !wal.setCodec(items[0]) {
+		return
+	}
+	code := byte(0)
+	for i, s := range walIncls {
+		if s == incl {
+			code = byte(i)
+		}
+	}
+	wal.commit(wal.encode(append(wal.buf[:0], op, code, bounds), items))
+}
+
+func (wal *WAL) appendBatch(ops []byte, items []Item) {
+	if len(items) > 0 && !wal.setCodec(items[0]) {
+		return
+	}
+	payload := append(wal.buf[:0], walBatch)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(ops)))
+	wal.commit(wal.encode(append(payload, ops...), items))
+}
+
+// setCodec picks the codec for item, on the first record carrying
+// an item, and logs it.
+func (wal *WAL) setCodec(item Item) bool {
+	if wal.err != nil {
+		return false
+	} else if wal.codec != nil {
+		return true
+	}
+	codec := codecsByType[reflect.TypeOf(item)]
+	if codec == nil {
+		wal.err = fmt.Errorf("llrb: no codec for %T", item)
+		return false
+	}
+	wal.codec = codec
+	wal.write(append(append(wal.buf[:0], walCodec), codec.Name()...))
+	return true
+}
+
+// encode appends items to payload, all but the last item are
+// length prefixed.
+func (wal *WAL) encode(payload []byte, items []Item) []byte {
+	for i, item := range items {
+		if i == len(items)-1 {
+			payload = wal.codec.Encode(item, payload)
+			break
+		}
+		n := len(payload)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = wal.codec.Encode(item, payload)
+		binary.BigEndian.PutUint32(payload[n:], uint32(len(payload)-n-4))
+	}
+	return payload
+}
+
+func (wal *WAL) commit(payload []byte) {
+	if wal.Err() != nil {
+		return
+	}
+	wal.write(payload)
+	if wal.err == nil {
+		wal.err = wal.w.Flush()
+	}
+	if wal.pending++; wal.pending >= wal.syncevery {
+		wal.Sync()
+	} else {
+		atomic.StoreInt32(&wal.dirty, 1)
+	}
+}
+
+func (wal *WAL) write(payload []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.Checksum(payload, crcTable))
+	if _, wal.err = wal.w.Write(hdr[:]); wal.err == nil {
+		_, wal.err = wal.w.Write(payload)
+	}
+	wal.size += int64(len(hdr) + len(payload))
+	wal.buf = payload[:0]
+}
+
+//---------
+// recovery
+//---------
+
+// Checkpoint durably dumps the tree into file at path and then
+// truncates the attached log. Shall be called on the writer, and
+// writes are blocked until the checkpoint is complete so that the
+// dump and the log are consistent with each other. Dump is numbered
+// so that, if Checkpoint crashes after the dump is in place and
+// before the log is truncated, recovery does not replay the log on
+// top of the dump.
+func (t *LLRBMVCC) Checkpoint(path string) error {
+	t.mustWriter()
+	checkpoint := t.checkpoint + 1
+	tmppath := path + ".tmp"
+	fd, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+	snapshot := t.RSnapshot(0).(*LLRBMVCC)
+	err = dumpTree(fd, snapshot.Root(), snapshot.count, t.dups, checkpoint)
+	snapshot.Release()
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmppath, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	t.checkpoint = checkpoint
+	if t.wal != nil {
+		return t.wal.restart(checkpoint)
+	}
+	return nil
+}
+
+// Recover loads the tree from the dump file at snappath, if it
+// exists, and replays the log file at walpath, if it exists, on
+// top of it. A torn record at the tail of the log is truncated
+// from the log file, and the log is emptied if it is covered by
+// the dump. Returns ErrCorruptDump if an invalid record is followed
+// by a valid record. Shall be called on an empty writer before
+// attaching a log.
+func (t *LLRBMVCC) Recover(snappath, walpath string) error {
+	if t.wal != nil {
+		panic("cannot recover with wal attached")
+	}
+	if fd, err := os.Open(snappath); err == nil {
+		t.checkpoint, err = t.load(fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	fd, err := os.OpenFile(walpath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+	offset, err := t.replay(fd)
+	if err != nil {
+		return err
+	}
+	if info, err := fd.Stat(); err != nil {
+		return err
+	} else if info.Size() > offset { // torn tail, or covered by dump
+		if err := fd.Truncate(offset); err != nil {
+			return err
+		}
+		return fd.Sync()
+	}
+	return nil
+}
+
+// replay applies records from r, returns the offset of the last
+// valid record. If the log is covered by the loaded dump, no record
+// is applied and offset is zero.
+func (t *LLRBMVCC) replay(r io.Reader) (int64, error) {
+	var codec Codec
+	var hdr [8]byte
+	var payload []byte
+	offset, br := int64(0), bufio.NewReader(r)
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return offset, nil // empty, or short header at the tail
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n == 0 || n > maxItemLen {
+			return offset, tornTail(hdr[:], br)
+		}
+		if cap(payload) < int(n) {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return offset, nil // short record at the tail
+		} else if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:]) {
+			return offset, tornTail(append(hdr[:], payload...), br)
+		}
+
+		op, data := payload[0], payload[1:]
+		if offset == 0 && op != walCheckpoint {
+			return 0, fmt.Errorf("llrb: log does not start with a checkpoint record")
+		}
+		switch op {
+		case walCodec:
+			if codec = codecsByName[string(data)]; codec == nil {
+				return offset, fmt.Errorf("llrb: no codec named %q", data)
+			}
+			offset += int64(len(hdr) + len(payload))
+			continue
+		case walCheckpoint:
+			if offset > 0 || len(data) != 8 {
+				return offset, ErrCorruptDump
+			} else if checkpoint := binary.BigEndian.Uint64(data); checkpoint < t.checkpoint {
+				return 0, nil
+			} else if checkpoint > t.checkpoint {
+				return 0, fmt.Errorf("llrb: log follows checkpoint %v, dump is %v",
+					checkpoint, t.checkpoint)
+			}
+			offset += int64(len(hdr) + len(payload))
+			continue
+		}
+
+		incl, bounds, nitems, ops := "", byte(0), 0, []byte(nil)
+		switch op {
+		case walUpsert, walInsert, walDelete, walDeleteItem:
+			nitems = 1
+		case walSwap:
+			nitems = 2
+		case walDeleteRange:
+			if len(data) < 2 || data[0] > 3 || data[1] > 3 {
+				return offset, ErrCorruptDump
+			}
+			incl, bounds = walIncls[data[0]], data[1]
+			nitems, data = bits.OnesCount8(bounds), data[2:]
+		case walBatch:
+			if len(data) < 4 || binary.BigEndian.Uint32(data) > uint32(len(data)-4) {
+				return offset, ErrCorruptDump
+			}
+			nops := int(binary.BigEndian.Uint32(data))
+			ops, data = data[4:4+nops], data[4+nops:]
+			for _, op := range ops {
+				switch op {
+				case walUpsert, walInsert, walDelete:
+					nitems++
+				case walDeleteMin, walDeleteMax:
+				default:
+					return offset, ErrCorruptDump
+				}
+			}
+		case walDeleteMin, walDeleteMax:
+		default:
+			return offset, ErrCorruptDump
+		}
+		parts, items, err := decodeItems(codec, data, nitems)
+		if err != nil {
+			return offset, err
+		}
+
+		switch op {
+		case walUpsert:
+			t.upsertKey(items[0])
+		case walInsert:
+			t.insertKey(items[0])
+		case walDelete:
+			t.deleteKey(items[0])
+		case walDeleteMin:
+			t.deleteMin()
+		case walDeleteMax:
+			t.deleteMax()
+		case walDeleteItem:
+			t.deleteDuplicate(items[0], func(x Item) bool {
+				return bytes.Equal(codec.Encode(x, nil), parts[0])
+			})
+		case walSwap:
+			t.swapDuplicate(items[1], func(x Item) bool {
+				return bytes.Equal(codec.Encode(x, nil), parts[0])
+			})
+		case walDeleteRange:
+			var low, high Item
+			if bounds&0x1 != 0 {
+				low, items = items[0], items[1:]
+			}
+			if bounds&0x2 != 0 {
+				high = items[0]
+			}
+			t.deleteRange(low, high, incl)
+		case walBatch:
+			t.commit(ops, items)
+		}
+		offset += int64(len(hdr) + len(payload))
+	}
+}
+
+// decodeItems decodes n items from data, all but the last item are
+// length prefixed. Returns the encoded items along with the items.
+func decodeItems(codec Codec, data []byte, n int) ([][]byte, []Item, error) {
+	if n == 0 {
+		return nil, nil, nil
+	} else if codec == nil {
+		return nil, nil, ErrCorruptDump
+	}
+	parts, items := make([][]byte, 0, n), make([]Item, 0, n)
+	for i := 0; i < n; i++ {
+		part := data
+		if i < n-1 {
+			if len(data) < 4 || binary.BigEndian.Uint32(data) > uint32(len(data)-4) {
+				return nil, nil, ErrCorruptDump
+			}
+			m := 4 + binary.BigEndian.Uint32(data)
+			part, data = data[4:m], data[m:]
+		}
+		item, err := codec.Decode(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts, items = append(parts, part), append(items, item)
+	}
+	return parts, items, nil
+}
+
+// tornTail returns ErrCorruptDump if a valid record starts anywhere
+// after the start of an invalid record, whose bytes are in bad, and
+// r is the rest of the log. Else the invalid record is the end of
+// the log, left by a torn write.
+func tornTail(bad []byte, r io.Reader) error {
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	rest = append(bad, rest...)
+	for off := 1; off+8 < len(rest); off++ {
+		n := int64(binary.BigEndian.Uint32(rest[off:]))
+		if n == 0 || n > maxItemLen || int64(off+8)+n > int64(len(rest)) {
+			continue
+		}
+		payload := rest[off+8 : int64(off+8)+n]
+		if crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(rest[off+4:]) {
+			return ErrCorruptDump
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}